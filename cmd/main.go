@@ -3,12 +3,14 @@ package main
 import (
 	"embed"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/andesco/ladder/handlers"
 	"github.com/andesco/ladder/handlers/cli"
+	"github.com/andesco/ladder/pkg/logging"
 
 	"github.com/akamensky/argparse"
 	"github.com/gofiber/fiber/v2"
@@ -23,6 +25,17 @@ var faviconData string
 var cssData embed.FS
 
 func main() {
+	// ruleset utility subcommands, e.g. ladder ruleset validate <ruleset.yaml>
+	if len(os.Args) > 1 && os.Args[1] == "ruleset" {
+		err := cli.HandleRulesetCommand(os.Args[1:], os.Stdout)
+		if err != nil {
+			// the problems of a ruleset are the output of the command, not log messages
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	parser := argparse.NewParser("ladder", "Every Wall needs a Ladder")
 
 	portEnv := os.Getenv("PORT")
@@ -61,6 +74,51 @@ func main() {
 		Help:     "Specify output file for --merge-rulesets and --merge-rulesets-gzip. Requires --ruleset and --merge-rulesets args.",
 	})
 
+	httpTimeout := parser.String("", "http-timeout", &argparse.Options{
+		Required: false,
+		Help:     "Time to wait for the response headers of a site, in seconds or as a duration like 30s. Overrides HTTP_TIMEOUT environment variable.",
+	})
+
+	httpReadTimeout := parser.String("", "http-read-timeout", &argparse.Options{
+		Required: false,
+		Help:     "Time to wait for the next part of the response body of a site. Overrides HTTP_READ_TIMEOUT environment variable.",
+	})
+
+	httpDialTimeout := parser.String("", "http-dial-timeout", &argparse.Options{
+		Required: false,
+		Help:     "Time to establish a connection to a site. Overrides HTTP_DIAL_TIMEOUT environment variable.",
+	})
+
+	httpTLSHandshakeTimeout := parser.String("", "http-tls-handshake-timeout", &argparse.Options{
+		Required: false,
+		Help:     "Time to complete the TLS handshake with a site. Overrides HTTP_TLS_HANDSHAKE_TIMEOUT environment variable.",
+	})
+
+	httpKeepAlive := parser.String("", "http-keepalive", &argparse.Options{
+		Required: false,
+		Help:     "Interval of TCP keep-alive probes, negative disables them. Overrides HTTP_KEEPALIVE environment variable.",
+	})
+
+	httpIdleConnTimeout := parser.String("", "http-idle-conn-timeout", &argparse.Options{
+		Required: false,
+		Help:     "Time an idle connection is kept open for reuse. Overrides HTTP_IDLE_CONN_TIMEOUT environment variable.",
+	})
+
+	httpMaxIdleConnsPerHost := parser.Int("", "http-max-idle-conns-per-host", &argparse.Options{
+		Required: false,
+		Help:     "Number of idle connections kept open per site. Overrides HTTP_MAX_IDLE_CONNS_PER_HOST environment variable.",
+	})
+
+	httpDisableKeepAlives := parser.Flag("", "http-disable-keepalives", &argparse.Options{
+		Required: false,
+		Help:     "Use a new connection for every request.",
+	})
+
+	httpDisableHTTP2 := parser.Flag("", "http-disable-http2", &argparse.Options{
+		Required: false,
+		Help:     "Only use HTTP/1.1 to connect to sites.",
+	})
+
 	err := parser.Parse(os.Args)
 	if err != nil {
 		fmt.Print(parser.Usage(err))
@@ -74,30 +132,72 @@ func main() {
 			output, err = os.Create(*mergeRulesetsOutput)
 			
 			if err != nil {
-				fmt.Println(err)
+				slog.Error("failed to create merged ruleset", logging.Err(err))
 				os.Exit(1)
 			}
 		}
 
 		err = cli.HandleRulesetMerge(*ruleset, *mergeRulesets, *mergeRulesetsGzip, output)
 		if err != nil {
-			fmt.Println(err)
+			slog.Error("failed to merge rulesets", logging.Err(err))
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
+	transportConfig := handlers.TransportConfigFromEnv()
+	durationFlags := []struct {
+		value  string
+		target *time.Duration
+	}{
+		{*httpTimeout, &transportConfig.Timeout},
+		{*httpReadTimeout, &transportConfig.ReadTimeout},
+		{*httpDialTimeout, &transportConfig.DialTimeout},
+		{*httpTLSHandshakeTimeout, &transportConfig.TLSHandshakeTimeout},
+		{*httpKeepAlive, &transportConfig.KeepAlive},
+		{*httpIdleConnTimeout, &transportConfig.IdleConnTimeout},
+	}
+	for _, flag := range durationFlags {
+		if flag.value == "" {
+			continue
+		}
+		*flag.target, err = handlers.ParseDuration(flag.value)
+		if err != nil {
+			slog.Error("invalid duration", "value", flag.value, logging.Err(err))
+			os.Exit(1)
+		}
+	}
+	if *httpMaxIdleConnsPerHost > 0 {
+		transportConfig.MaxIdleConnsPerHost = *httpMaxIdleConnsPerHost
+	}
+	if *httpDisableKeepAlives {
+		transportConfig.DisableKeepAlives = true
+	}
+	if *httpDisableHTTP2 {
+		transportConfig.DisableHTTP2 = true
+	}
+	handlers.ConfigureTransport(transportConfig)
+
 	if os.Getenv("PREFORK") == "true" {
 		*prefork = true
 	}
 
+	// cache purges are the only requests that are not GET requests
 	app := fiber.New(
 		fiber.Config{
 			Prefork: *prefork,
-			GETOnly: true,
+			GETOnly: os.Getenv("CACHE_PURGE_TOKEN") == "",
 		},
 	)
 
+	app.Use(handlers.LogRequests())
+
+	// before basic auth, probes do not authenticate, metrics and cache purges have their own token
+	app.Get("healthz", handlers.Healthz)
+	app.Get("readyz", handlers.Readyz())
+	app.Get("metrics", handlers.Metrics())
+	app.All("cache/purge", handlers.CachePurge)
+
 	userpass := os.Getenv("USERPASS")
 	if userpass != "" {
 		userpass := strings.Split(userpass, ":")
@@ -114,14 +214,6 @@ func main() {
 		URL:  "/favicon.ico",
 	}))
 
-	if os.Getenv("NOLOGS") != "true" {
-		app.Use(func(c *fiber.Ctx) error {
-			log.Println(c.Method(), c.Path())
-
-			return c.Next()
-		})
-	}
-
 	app.Get("/", handlers.Form)
 
 	app.Get("/styles.css", func(c *fiber.Ctx) error {
@@ -136,9 +228,14 @@ func main() {
 	})
 
 	app.Get("ruleset", handlers.Ruleset)
+	app.Get("version", handlers.Version)
 	app.Get("raw/*", handlers.Raw)
 	app.Get("api/*", handlers.Api)
+	app.Get("reader/*", handlers.Reader)
 	app.Get("/*", handlers.ProxySite(*ruleset))
 
-	log.Fatal(app.Listen(":" + *port))
+	if err := app.Listen(":" + *port); err != nil {
+		slog.Error("server stopped", logging.Err(err))
+		os.Exit(1)
+	}
 }
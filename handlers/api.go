@@ -2,7 +2,13 @@ package handlers
 
 import (
 	_ "embed"
-	"log"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -11,49 +17,150 @@ import (
 //go:embed VERSION
 var version string
 
+// Api fetches a page like ProxySite and returns it in JSON, together with details of the upstream
+// request and response, the rule that was applied and the timings of the fetch.
 func Api(c *fiber.Ctx) error {
 	// Get the url from the URL
 	urlQuery := c.Params("*")
 
 	queries := c.Queries()
-	body, req, resp, err := FetchSite(urlQuery, queries)
+	format := outputFormat(queries)
+
+	start := time.Now()
+	timings := &fetchTimings{}
+	res, err := fetchSite(urlQuery, queries, fetchOptions{followRedirects: true, timings: timings, logger: requestLogger(c)})
 	if err != nil {
-		log.Println("ERROR:", err)
+		requestLogger(c).Error("failed to fetch site", logging.Err(err))
+		c.SendStatus(errorStatus(err))
+		return c.SendString(err.Error())
+	}
+	defer res.Body.Close()
+
+	var out string
+	if format == "html" {
+		var bodyB []byte
+		bodyB, err = io.ReadAll(res.Body)
+		out = string(bodyB)
+	} else {
+		out, err = renderArticle(res.Body, res.Response, format)
+	}
+	if errors.Is(err, errNotHTML) {
+		c.SendStatus(fiber.StatusUnsupportedMediaType)
+		return c.SendString(err.Error())
+	}
+	if err != nil {
+		requestLogger(c).Error("failed to render article", logging.Err(err))
 		c.SendStatus(500)
 		return c.SendString(err.Error())
 	}
 
 	response := Response{
 		Version: version,
-		Body:    body,
+		Format:  format,
+		Body:    out,
 	}
 
-	response.Request.Headers = make([]any, 0, len(req.Header))
-	for k, v := range req.Header {
-		response.Request.Headers = append(response.Request.Headers, map[string]string{
-			"key":   k,
-			"value": v[0],
-		})
+	response.Request.URL = res.Request.URL.String()
+	response.Request.Headers = headerList(res.Request.Header)
+
+	response.Response.Status = res.Response.StatusCode
+	response.Response.URL = res.Response.Request.URL.String()
+	response.Response.Redirects = redirectChain(res.Response)
+	response.Response.Headers = headerList(res.Response.Header)
+
+	response.Rule.Domain = res.Rule.Domain
+	response.Rule.Domains = res.Rule.Domains
+	response.Rule.Name = res.Rule.Name
+	response.Rule.Source = res.Rule.Source
+	response.Rule.Strategy = res.Strategy
+
+	response.Timings = timings.report(time.Since(start))
+
+	return c.JSON(response)
+}
+
+// headerList returns all values of all headers in h, sorted by header name.
+func headerList(h http.Header) []Header {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	response.Response.Headers = make([]any, 0, len(resp.Header))
-	for k, v := range resp.Header {
-		response.Response.Headers = append(response.Response.Headers, map[string]string{
-			"key":   k,
-			"value": v[0],
-		})
+	list := make([]Header, 0, len(h))
+	for _, k := range keys {
+		for _, v := range h[k] {
+			list = append(list, Header{Key: k, Value: v})
+		}
 	}
+	return list
+}
 
-	return c.JSON(response)
+// redirectChain returns the redirects that led to resp, in the order they were followed.
+func redirectChain(resp *http.Response) []Redirect {
+	chain := []Redirect{}
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		chain = append([]Redirect{{
+			URL:      req.Response.Request.URL.String(),
+			Status:   req.Response.StatusCode,
+			Location: req.Response.Header.Get("Location"),
+		}}, chain...)
+	}
+	return chain
 }
 
 type Response struct {
 	Version string `json:"version"`
+	// Format is the format of Body: html, markdown or text
+	Format  string `json:"format"`
 	Body    string `json:"body"`
 	Request struct {
-		Headers []interface{} `json:"headers"`
+		// URL is the URL requested from the site, with the rule's urlMods applied
+		URL     string   `json:"url"`
+		Headers []Header `json:"headers"`
 	} `json:"request"`
 	Response struct {
-		Headers []interface{} `json:"headers"`
+		Status int `json:"status"`
+		// URL is the URL of the page after all redirects
+		URL       string     `json:"url"`
+		Redirects []Redirect `json:"redirects"`
+		Headers   []Header   `json:"headers"`
 	} `json:"response"`
+	// Rule is the rule that was applied to the page
+	Rule struct {
+		Name    string   `json:"name,omitempty"`
+		Domain  string   `json:"domain,omitempty"`
+		Domains []string `json:"domains,omitempty"`
+		// Source is the file or URL the rule was loaded from
+		Source string `json:"source,omitempty"`
+		// Strategy is the strategy that fetched the page
+		Strategy string `json:"strategy,omitempty"`
+	} `json:"rule"`
+	Timings Timings `json:"timings"`
+}
+
+// Header is a single value of a header. Headers with several values are listed once per value.
+type Header struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Redirect is a redirect response that was followed.
+type Redirect struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Location string `json:"location"`
+}
+
+// Timings are the durations of the phases of a fetch, in milliseconds. DNS, connect and TLS are zero
+// if a connection was reused, all but total are zero for cached responses.
+type Timings struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	TLS     float64 `json:"tls"`
+	// TTFB is the time until the first byte of the response arrived
+	TTFB float64 `json:"ttfb"`
+	// Rewrite is the time it took to read and rewrite the body
+	Rewrite float64 `json:"rewrite"`
+	Total   float64 `json:"total"`
 }
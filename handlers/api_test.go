@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiResponse(t *testing.T) {
+	defer rules.Store(rules.Load())
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(w, r, "/article", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Add("Set-Cookie", "a=1")
+			w.Header().Add("Set-Cookie", "b=2")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<p>gone</p>")
+		}
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	useRuleset(ruleset.RuleSet{{
+		Domain:     u.Hostname(),
+		Source:     "rulesets/example.yaml",
+		Strategies: []ruleset.Strategy{{Name: "direct", Success: ruleset.Success{Status: []int{404}}}},
+	}})
+
+	app := fiber.New()
+	app.Get("/api/*", Api)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/"+upstream.URL+"/old", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var response Response
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+
+	assert.Equal(t, "html", response.Format)
+	assert.Contains(t, response.Body, "<p>gone</p>")
+	assert.Equal(t, upstream.URL+"/old", response.Request.URL)
+	assert.Equal(t, http.StatusNotFound, response.Response.Status)
+	assert.Equal(t, upstream.URL+"/article", response.Response.URL)
+	assert.Equal(t, []Redirect{
+		{URL: upstream.URL + "/old", Status: http.StatusMovedPermanently, Location: "/moved"},
+		{URL: upstream.URL + "/moved", Status: http.StatusFound, Location: "/article"},
+	}, response.Response.Redirects)
+	assert.Contains(t, response.Response.Headers, Header{Key: "Set-Cookie", Value: "a=1"})
+	assert.Contains(t, response.Response.Headers, Header{Key: "Set-Cookie", Value: "b=2"})
+	assert.Equal(t, u.Hostname(), response.Rule.Domain)
+	assert.Equal(t, "rulesets/example.yaml", response.Rule.Source)
+	assert.Equal(t, "direct", response.Rule.Strategy)
+	assert.Greater(t, response.Timings.TTFB, 0.0)
+	assert.Greater(t, response.Timings.Connect, 0.0)
+	assert.GreaterOrEqual(t, response.Timings.Total, response.Timings.TTFB)
+}
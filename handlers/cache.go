@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andesco/ladder/pkg/cache"
+	"github.com/andesco/ladder/pkg/logging"
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// responseCache is nil unless CACHE is set to memory or disk.
+	responseCache = newCacheFromEnv()
+	// cacheTTL is how long a response is served from the cache before it is revalidated. Rules can override it.
+	cacheTTL = getenvDuration("CACHE_TTL", 10*time.Minute)
+	// cacheMaxEntrySize is the largest response body in bytes that is cached.
+	cacheMaxEntrySize = getenvInt("CACHE_MAX_ENTRY_SIZE", 10<<20)
+	// cachePurgeToken is the bearer token required by /cache/purge, which is disabled if it is empty.
+	cachePurgeToken = os.Getenv("CACHE_PURGE_TOKEN")
+)
+
+// cacheSweepInterval is how often expired responses are removed from the cache.
+const cacheSweepInterval = 10 * time.Minute
+
+// varyCovered are the request headers that only depend on the URL and the rule, which are part of the
+// cache key. Responses that vary on any other request header are not cached.
+var varyCovered = []string{"Accept-Encoding", "User-Agent", "Referer", "X-Forwarded-For", "Cookie"}
+
+func newCacheFromEnv() cache.Store {
+	var store cache.Store
+	maxSize := int64(getenvInt("CACHE_MAX_SIZE", 256<<20))
+
+	switch os.Getenv("CACHE") {
+	case "":
+		return nil
+	case "memory":
+		store = cache.NewMemory(maxSize)
+	case "disk":
+		disk, err := cache.NewDisk(getenv("CACHE_DIR", filepath.Join(os.TempDir(), "ladder-cache")), maxSize)
+		if err != nil {
+			slog.Error("cache disabled", logging.Err(err))
+			return nil
+		}
+		store = disk
+	default:
+		slog.Warn("unknown CACHE, use memory or disk. Cache disabled.", "cache", os.Getenv("CACHE"))
+		return nil
+	}
+
+	go sweepCache(store, cacheSweepInterval)
+	return store
+}
+
+// sweepCache removes expired responses from store every interval. Responses that can be revalidated
+// are kept for another CACHE_TTL, so that a request can still refresh them with a 304 Not Modified.
+func sweepCache(store cache.Store, interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := store.Purge(cache.MatchExpired(time.Now(), cacheTTL)); n > 0 {
+			slog.Debug("removed expired responses from the cache", "count", n)
+		}
+	}
+}
+
+// cacheSettings returns the cache key and TTL for a request to url with the given rule.
+// The rule is part of the key, because the cached body is the rewritten one, and so is the
+// redirect policy, because a followed redirect must not be served to requests that pass redirects on.
+// The last return value is false if the response must not be cached.
+func cacheSettings(url string, rule ruleset.Rule, followRedirects bool) (string, time.Duration, bool) {
+	if responseCache == nil || (rule.Cache.Disabled != nil && *rule.Cache.Disabled) {
+		return "", 0, false
+	}
+
+	ttl := cacheTTL
+	if rule.Cache.TTL != "" {
+		var err error
+		ttl, err = ParseDuration(rule.Cache.TTL)
+		if err != nil {
+			slog.Warn("invalid cache ttl in rule", "ttl", rule.Cache.TTL, "default", cacheTTL, logging.Private("rule", rule.Label()))
+			ttl = cacheTTL
+		}
+	}
+
+	r, err := yaml.Marshal(rule)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return cache.Key(url, strconv.FormatBool(followRedirects), string(r)), ttl, true
+}
+
+// cacheable reports whether an upstream response to a request with rule may be stored in the cache,
+// which is shared by all users. Private responses and responses that vary on request headers other
+// than the ones the rule sets are not.
+func cacheable(resp *http.Response, rule ruleset.Rule) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive, _, _ = strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(directive, "no-store") || strings.EqualFold(directive, "private") {
+			return false
+		}
+	}
+
+	covered := append(rule.RequestHeaders.Modified(), varyCovered...)
+	for _, vary := range resp.Header.Values("Vary") {
+		for _, key := range strings.Split(vary, ",") {
+			if key = strings.TrimSpace(key); key != "" && !headerIn(key, covered) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// revalidate adds the conditional request headers for a stale cache entry to req.
+func revalidate(req *http.Request, e *cache.Entry) {
+	if etag := e.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// cachedResponse builds the response for a cache entry. status is reported in the X-Ladder-Cache header.
+func cachedResponse(req *http.Request, e *cache.Entry, status string) *http.Response {
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	resp.Header.Set("X-Ladder-Cache", status)
+
+	return resp
+}
+
+// cachingBody passes a response body through and stores it in the cache once it
+// has been read completely. Bodies larger than cacheMaxEntrySize are not stored.
+type cachingBody struct {
+	io.ReadCloser
+	key      string
+	entry    *cache.Entry
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func newCachingBody(body io.ReadCloser, key string, entry *cache.Entry) *cachingBody {
+	return &cachingBody{ReadCloser: body, key: key, entry: entry}
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if !b.overflow {
+		if b.buf.Len()+n > cacheMaxEntrySize {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !b.overflow && b.entry != nil {
+		b.entry.Body = b.buf.Bytes()
+		if err := responseCache.Set(b.key, b.entry); err != nil {
+			slog.Warn("failed to cache response", logging.Err(err))
+		}
+		b.entry = nil
+	}
+
+	return n, err
+}
+
+// CachePurge removes cached responses of a URL (?url=) or of a domain and its subdomains (?domain=).
+// It is disabled unless CACHE_PURGE_TOKEN is set, and requests need to be POST requests that authenticate
+// with `Authorization: Bearer <token>`, so that other sites cannot purge the cache through their visitors.
+// USERPASS does not apply to it.
+func CachePurge(c *fiber.Ctx) error {
+	if responseCache == nil || cachePurgeToken == "" {
+		c.SendStatus(fiber.StatusNotFound)
+		return c.SendString("Cache Purge Disabled")
+	}
+
+	if c.Method() != fiber.MethodPost {
+		c.Set(fiber.HeaderAllow, fiber.MethodPost)
+		c.SendStatus(fiber.StatusMethodNotAllowed)
+		return c.SendString("Method Not Allowed")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Get("Authorization")), []byte("Bearer "+cachePurgeToken)) != 1 {
+		c.SendStatus(fiber.StatusUnauthorized)
+		return c.SendString("Unauthorized")
+	}
+
+	var purged int
+	switch {
+	case c.Query("url") != "":
+		u, err := url.Parse(c.Query("url"))
+		if err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return c.SendString(err.Error())
+		}
+		purged = responseCache.Purge(cache.MatchURL(u.String()))
+	case c.Query("domain") != "":
+		purged = responseCache.Purge(cache.MatchDomain(c.Query("domain")))
+	default:
+		c.SendStatus(fiber.StatusBadRequest)
+		return c.SendString("missing url or domain query parameter")
+	}
+
+	return c.JSON(fiber.Map{"purged": purged})
+}
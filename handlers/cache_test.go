@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andesco/ladder/pkg/cache"
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchSiteCache(t *testing.T) {
+	var hits, notModified atomic.Int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, `<img src="/a.png">`)
+	}))
+	defer upstream.Close()
+
+	defer func(store cache.Store, ttl time.Duration) {
+		responseCache, cacheTTL = store, ttl
+	}(responseCache, cacheTTL)
+	responseCache = cache.NewMemory(1 << 20)
+	cacheTTL = time.Minute
+
+	expected := `<img src="/` + upstream.URL + `/a.png">`
+
+	body, resp := fetchString(t, upstream.URL+"/article")
+	assert.Equal(t, expected, body)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Ladder-Cache"))
+
+	body, resp = fetchString(t, upstream.URL+"/article")
+	assert.Equal(t, expected, body)
+	assert.Equal(t, "HIT", resp.Header.Get("X-Ladder-Cache"))
+	assert.Equal(t, int32(1), hits.Load())
+
+	// expire the entry, the next request revalidates it
+	key, _, _ := cacheSettings(upstream.URL+"/article", ruleset.Rule{}, true)
+	entry, _ := responseCache.Get(key)
+	entry.Expires = time.Now()
+
+	body, resp = fetchString(t, upstream.URL+"/article")
+	assert.Equal(t, expected, body)
+	assert.Equal(t, "REVALIDATED", resp.Header.Get("X-Ladder-Cache"))
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Equal(t, int32(1), notModified.Load())
+}
+
+func TestFetchSiteCacheStrategies(t *testing.T) {
+	var validated []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			validated = append(validated, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path != "/mirror" {
+			w.Header().Set("ETag", `"site"`)
+			io.WriteString(w, `<div class="paywall">subscribe</div>`)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"mirror"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"mirror"`)
+		io.WriteString(w, `<article><p>mirrored copy</p></article>`)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+
+	defer rules.Store(rules.Load())
+	rule := ruleset.Rule{
+		Domain:  u.Host,
+		Success: ruleset.Success{Selector: "article p"},
+		Strategies: []ruleset.Strategy{
+			{Name: "direct"},
+			{Name: "mirror", URL: upstream.URL + "/mirror?u={url_encoded}"},
+		},
+	}
+	useRuleset(ruleset.RuleSet{rule})
+
+	defer func(store cache.Store) { responseCache = store }(responseCache)
+	responseCache = cache.NewMemory(1 << 20)
+
+	_, resp := fetchString(t, upstream.URL+"/article")
+	assert.Equal(t, "MISS", resp.Header.Get("X-Ladder-Cache"))
+
+	key, _, _ := cacheSettings(upstream.URL+"/article", rule, true)
+	entry, _ := responseCache.Get(key)
+	entry.Expires = time.Now()
+
+	// only the mirror that produced the entry is asked to revalidate it
+	body, resp := fetchString(t, upstream.URL+"/article")
+	assert.Equal(t, "REVALIDATED", resp.Header.Get("X-Ladder-Cache"))
+	assert.Contains(t, body, "mirrored copy")
+	assert.Equal(t, []string{"/mirror"}, validated)
+}
+
+func TestFetchSiteCacheRedirects(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "new page")
+	}))
+	defer upstream.Close()
+
+	defer func(store cache.Store) { responseCache = store }(responseCache)
+	responseCache = cache.NewMemory(1 << 20)
+
+	// the api follows the redirect and caches the page it led to
+	body, resp := fetchString(t, upstream.URL+"/old")
+	assert.Equal(t, "new page", body)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Ladder-Cache"))
+
+	// the proxy passes the redirect on instead of serving that page
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/old", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/"+upstream.URL+"/new", resp.Header.Get("Location"))
+}
+
+func TestCacheable(t *testing.T) {
+	rule := ruleset.Rule{RequestHeaders: ruleset.HeaderOps{Set: map[string]string{"Accept-Language": "en"}}}
+
+	testCases := []struct {
+		status   int
+		header   http.Header
+		expected bool
+	}{
+		{http.StatusOK, http.Header{}, true},
+		{http.StatusNotFound, http.Header{}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60, Private"}}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false},
+		{http.StatusOK, http.Header{"Vary": {"Accept-Encoding, User-Agent"}}, true},
+		{http.StatusOK, http.Header{"Vary": {"accept-language"}}, true},
+		{http.StatusOK, http.Header{"Vary": {"Accept-Encoding", "Authorization"}}, false},
+		{http.StatusOK, http.Header{"Vary": {"*"}}, false},
+	}
+
+	for _, tc := range testCases {
+		resp := &http.Response{StatusCode: tc.status, Header: tc.header}
+		assert.Equal(t, tc.expected, cacheable(resp, rule), "%d %v", tc.status, tc.header)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	defer func(store cache.Store) { responseCache = store }(responseCache)
+	responseCache = cache.NewMemory(1 << 20)
+	responseCache.Set("a", &cache.Entry{URL: "https://www.example.com/a", StatusCode: http.StatusOK, Header: http.Header{}})
+	responseCache.Set("b", &cache.Entry{URL: "https://www.example.com/b", StatusCode: http.StatusOK, Header: http.Header{}})
+
+	defer func(token string) { cachePurgeToken = token }(cachePurgeToken)
+	cachePurgeToken = ""
+
+	app := fiber.New()
+	app.All("/cache/purge", CachePurge)
+
+	// without a token, purging is disabled
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/cache/purge?domain=example.com", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	cachePurgeToken = "secret"
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodPost, "/cache/purge?domain=example.com", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// purges change the cache, so that GET requests, e.g. of images on other sites, cannot purge it
+	req := httptest.NewRequest(http.MethodGet, "/cache/purge?domain=example.com", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/purge?url=https://www.example.com/a", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"purged": 1}`, string(body))
+
+	// the query parameters of a URL may be in any order
+	responseCache.Set("c", &cache.Entry{URL: cache.NormalizeURL("https://www.example.com/c?b=2&a=1"), StatusCode: http.StatusOK, Header: http.Header{}})
+	req = httptest.NewRequest(http.MethodPost, "/cache/purge?url="+url.QueryEscape("https://www.example.com/c?a=1&b=2"), nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"purged": 1}`, string(body))
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/purge?domain=example.com", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"purged": 1}`, string(body))
+}
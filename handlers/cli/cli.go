@@ -3,8 +3,10 @@ package cli
 import (
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 
+	"github.com/andesco/ladder/pkg/logging"
 	"github.com/andesco/ladder/pkg/ruleset"
 
 	"golang.org/x/term"
@@ -31,13 +33,13 @@ func HandleRulesetMerge(rulesetPath string, mergeRulesets bool, useGzip bool, ou
 	}
 
 	if rulesetPath == "" {
-		fmt.Println("error: no ruleset provided. Try again with --ruleset <ruleset.yaml>")
+		slog.Error("no ruleset provided. Try again with --ruleset <ruleset.yaml>")
 		os.Exit(1)
 	}
 
 	rs, err := ruleset.NewRuleset(rulesetPath)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("failed to load ruleset", logging.Err(err))
 		os.Exit(1)
 	}
 
@@ -72,7 +74,7 @@ func gzipMerge(rs ruleset.RuleSet, output io.Writer) error {
 	}
 
 	if term.IsTerminal(int(os.Stdout.Fd())) {
-		println("warning: binary output can mess up your terminal. Use '--merge-rulesets-output <ruleset.gz>' or pipe it to a file.")
+		slog.Warn("binary output can mess up your terminal. Use '--merge-rulesets-output <ruleset.gz>' or pipe it to a file.")
 		os.Exit(1)
 	}
 
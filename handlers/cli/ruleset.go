@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/andesco/ladder/handlers"
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/akamensky/argparse"
+)
+
+// HandleRulesetCommand runs the `ladder ruleset` subcommands. args starts with "ruleset".
+//
+// Subcommands:
+// - validate [path]: checks the rulesets at path, or the RULESET env variable, and reports every problem.
+// - test [path]: runs the tests of the rules at path, or the RULESET env variable, against their fixtures.
+// - keygen --output <file>: creates a key pair to sign rulesets with, and prints the public key.
+// - sign --key <file> <ruleset>: writes the detached signature of a ruleset, e.g. from --merge-rulesets-output, to <ruleset>.sig.
+//
+// Returns:
+// - An error if the arguments are invalid or the subcommand fails, otherwise nil.
+func HandleRulesetCommand(args []string, output io.Writer) error {
+	parser := argparse.NewParser("ladder ruleset", "Work with rulesets")
+
+	validate := parser.NewCommand("validate", "Checks rulesets for unknown keys, invalid regexes and selectors. Exits non-zero on problems.")
+	validatePath := validate.StringPositional(&argparse.Options{
+		Required: false,
+		Help:     "File, Directory or URL to a ruleset.yaml, or several separated by semicolons. Defaults to the RULESET environment variable.",
+	})
+
+	test := parser.NewCommand("test", "Runs the tests of rules against their recorded fixtures, offline. Exits non-zero if a test fails.")
+	testPath := test.StringPositional(&argparse.Options{
+		Required: false,
+		Help:     "File, Directory or URL to a ruleset.yaml, or several separated by semicolons. Defaults to the RULESET environment variable.",
+	})
+
+	keygen := parser.NewCommand("keygen", "Creates a key pair to sign rulesets with. Add the public key to RULESET_PUBLIC_KEYS of your ladders.")
+	keygenOutput := keygen.String("o", "output", &argparse.Options{
+		Required: true,
+		Help:     "File to write the private key to.",
+	})
+
+	sign := parser.NewCommand("sign", "Writes the detached signature of a ruleset file to <ruleset>.sig. Publish it next to the ruleset.")
+	signKey := sign.String("k", "key", &argparse.Options{
+		Required: true,
+		Help:     "File with the private key from ladder ruleset keygen.",
+	})
+	signPath := sign.StringPositional(&argparse.Options{
+		Required: true,
+		Help:     "Ruleset file to sign, e.g. the output of --merge-rulesets-output.",
+	})
+
+	if err := parser.Parse(args); err != nil {
+		return errors.New(parser.Usage(err))
+	}
+
+	switch {
+	case validate.Happened():
+		return validateRuleset(*validatePath, output)
+	case test.Happened():
+		return testRuleset(*testPath, output)
+	case keygen.Happened():
+		return generateKey(*keygenOutput, output)
+	case sign.Happened():
+		return signRuleset(*signKey, *signPath, output)
+	}
+
+	return nil
+}
+
+// validateRuleset loads the rulesets at rulesetPath strictly and writes a summary to output.
+func validateRuleset(rulesetPath string, output io.Writer) error {
+	if rulesetPath == "" {
+		rulesetPath = os.Getenv("RULESET")
+	}
+
+	if rulesetPath == "" {
+		return errors.New("error: no ruleset provided. Try again with ladder ruleset validate <ruleset.yaml>")
+	}
+
+	rs, err := ruleset.Validate(rulesetPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "ok: %d rules for %d domains\n", rs.Count(), rs.DomainCount())
+	return nil
+}
+
+// testRuleset runs the tests of the rulesets at rulesetPath and writes the report to output.
+func testRuleset(rulesetPath string, output io.Writer) error {
+	if rulesetPath == "" {
+		rulesetPath = os.Getenv("RULESET")
+	}
+
+	if rulesetPath == "" {
+		return errors.New("error: no ruleset provided. Try again with ladder ruleset test <ruleset.yaml>")
+	}
+
+	rs, err := ruleset.Validate(rulesetPath)
+	if err != nil {
+		return err
+	}
+
+	return handlers.RunRuleTests(rs, output)
+}
+
+// generateKey writes a new private key to keyPath and the matching public key to output.
+func generateKey(keyPath string, output io.Writer) error {
+	publicKey, privateKey, err := ruleset.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	// O_EXCL, so that an existing key is never overwritten
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, privateKey); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "private key written to %s\npublic key: %s\n", keyPath, publicKey)
+	return nil
+}
+
+// signRuleset writes the signature of the ruleset file at rulesetPath to rulesetPath.sig.
+func signRuleset(keyPath string, rulesetPath string, output io.Writer) error {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(rulesetPath)
+	if err != nil {
+		return err
+	}
+
+	signature, err := ruleset.Sign(data, string(key))
+	if err != nil {
+		return err
+	}
+
+	signaturePath := rulesetPath + ruleset.SignatureSuffix
+	if err := os.WriteFile(signaturePath, []byte(signature+"\n"), 0o644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "signature written to %s\n", signaturePath)
+	return nil
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"gopkg.in/yaml.v3"
+)
+
+// debugEnabled lets requests ask for a trace with the ladder_debug query parameter or the X-Ladder-Debug header.
+// Traces show the outbound headers and the rules, so they are off unless DEBUG is true.
+var debugEnabled = os.Getenv("DEBUG") == "true"
+
+const (
+	// debugOverlay shows the trace in a panel on top of HTML pages
+	debugOverlay = "overlay"
+	// debugJSON returns the trace as JSON instead of the page
+	debugJSON = "json"
+)
+
+//go:embed debug.html
+var debugHtml string
+
+var debugTemplate = template.Must(template.New("debug").Parse(debugHtml))
+
+// debugMode returns the trace format asked for by the ladder_debug query parameter, or else the X-Ladder-Debug
+// header, or an empty string. The parameter is taken out of queries, so that it is not sent to the site.
+func debugMode(queries map[string]string, header string) string {
+	value, ok := queries["ladder_debug"]
+	delete(queries, "ladder_debug")
+	if !ok {
+		value = header
+	}
+
+	if !debugEnabled {
+		return ""
+	}
+
+	switch strings.ToLower(value) {
+	case "json":
+		return debugJSON
+	case "1", "true", "overlay":
+		return debugOverlay
+	default:
+		return ""
+	}
+}
+
+// fetchTrace records what fetchSite did with a request.
+type fetchTrace struct {
+	mu    sync.Mutex
+	start time.Time
+	mode  string
+
+	// URL is the requested URL
+	URL string `json:"url"`
+	// ModifiedURL is the URL after the rule's urlMods
+	ModifiedURL string `json:"modifiedUrl"`
+	// Matched is false if no rule applied
+	Matched bool                `json:"matched"`
+	Match   ruleset.Explanation `json:"match"`
+	// Rule is the applied rule in YAML, merged with its templates and the global rules
+	Rule string `json:"rule"`
+
+	Request struct {
+		Headers []Header `json:"headers"`
+	} `json:"request"`
+	Response struct {
+		Status   int    `json:"status"`
+		Strategy string `json:"strategy,omitempty"`
+	} `json:"response"`
+
+	RegexRules []regexTrace    `json:"regexRules"`
+	DOM        []selectorTrace `json:"dom"`
+	Injections []selectorTrace `json:"injections"`
+
+	Timings Timings `json:"timings"`
+	timings fetchTimings
+}
+
+// regexTrace is the number of matches of a regexRule.
+type regexTrace struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+	Count   int    `json:"count"`
+	Error   string `json:"error,omitempty"`
+}
+
+// selectorTrace is the number of elements a DOM operation or injection affected.
+type selectorTrace struct {
+	Selector string `json:"selector"`
+	Count    int    `json:"count"`
+}
+
+func newFetchTrace(mode string) *fetchTrace {
+	return &fetchTrace{start: time.Now(), mode: mode, RegexRules: []regexTrace{}, DOM: []selectorTrace{}, Injections: []selectorTrace{}}
+}
+
+// match records the rule that was picked for a request, and why.
+func (t *fetchTrace) match(rule ruleset.Rule, explanation ruleset.Explanation, ok bool) {
+	t.Match, t.Matched = explanation, ok
+	if ok {
+		b, _ := yaml.Marshal(rule)
+		t.Rule = string(b)
+	}
+}
+
+// response records the request sent to the site and its response.
+func (t *fetchTrace) response(req *http.Request, resp *http.Response, strategy string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Request.Headers = headerList(req.Header)
+	t.Response.Status = resp.StatusCode
+	t.Response.Strategy = strategy
+}
+
+func (t *fetchTrace) regexRule(regexRule ruleset.Regex, count int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := regexTrace{Match: regexRule.Match, Replace: regexRule.Replace, Count: count}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	t.RegexRules = append(t.RegexRules, r)
+}
+
+func (t *fetchTrace) dom(selector string, count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.DOM = append(t.DOM, selectorTrace{Selector: selector, Count: count})
+}
+
+func (t *fetchTrace) injection(selector string, count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Injections = append(t.Injections, selectorTrace{Selector: selector, Count: count})
+}
+
+// finish fills in the timings. The trace must not be modified afterwards.
+func (t *fetchTrace) finish() *fetchTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Timings = t.timings.report(time.Since(t.start))
+	return t
+}
+
+// rewriteHtml is the html processor of traced requests. It records the effect of the rules.
+func (t *fetchTrace) rewriteHtml(w io.Writer, r io.Reader, u *url.URL, rule ruleset.Rule) error {
+	return rewriteHtmlTrace(w, r, u, rule, t)
+}
+
+// writePanel appends the trace panel to a page in overlay mode. It finishes the trace, so it is
+// called once the page has been rewritten.
+func (t *fetchTrace) writePanel(w io.Writer) error {
+	if t.mode != debugOverlay {
+		return nil
+	}
+
+	var panel bytes.Buffer
+	if err := debugTemplate.Execute(&panel, t.finish()); err != nil {
+		return err
+	}
+	_, err := panel.WriteTo(w)
+	return err
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxySiteDebugTrace(t *testing.T) {
+	defer rules.Store(rules.Load())
+	defer func(enabled bool) { debugEnabled = enabled }(debugEnabled)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("ladder_debug"))
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head></head><body><p class="ad">ad</p><p class="ad">ad</p><p>story story</p></body></html>`)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	useRuleset(ruleset.RuleSet{{
+		Domain:     u.Hostname(),
+		Headers:    ruleset.Headers{Referer: "https://www.google.com/"},
+		RegexRules: []ruleset.Regex{{Match: "story", Replace: "news"}},
+		DOM:        []ruleset.DOMOperation{{Selector: ".ad", Remove: true}},
+		Injections: []ruleset.Injection{{Position: "head", Append: "<script></script>"}},
+		URLMods: struct {
+			Domain []ruleset.Regex `yaml:"domain,omitempty"`
+			Path   []ruleset.Regex `yaml:"path,omitempty"`
+			Query  []ruleset.KV    `yaml:"query,omitempty"`
+		}{Query: []ruleset.KV{{Key: "amp", Value: "1"}}},
+	}})
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	get := func(path string, header string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if header != "" {
+			req.Header.Set("X-Ladder-Debug", header)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	debugEnabled = false
+	assert.NotContains(t, get("/"+upstream.URL+"/page?ladder_debug=1", ""), "ladder-debug")
+
+	debugEnabled = true
+	var trace fetchTrace
+	assert.NoError(t, json.Unmarshal([]byte(get("/"+upstream.URL+"/page?ladder_debug=json", "")), &trace))
+	assert.Equal(t, upstream.URL+"/page", trace.URL)
+	assert.Equal(t, upstream.URL+"/page?amp=1", trace.ModifiedURL)
+	assert.True(t, trace.Matched)
+	assert.Equal(t, u.Hostname(), trace.Match.Domain)
+	assert.Contains(t, trace.Rule, "referer: https://www.google.com/")
+	assert.Contains(t, trace.Request.Headers, Header{Key: "Referer", Value: "https://www.google.com/"})
+	assert.Equal(t, http.StatusOK, trace.Response.Status)
+	assert.Equal(t, []regexTrace{{Match: "story", Replace: "news", Count: 2}}, trace.RegexRules)
+	assert.Equal(t, []selectorTrace{{Selector: ".ad", Count: 2}}, trace.DOM)
+	assert.Equal(t, []selectorTrace{{Selector: "head", Count: 1}}, trace.Injections)
+	assert.Greater(t, trace.Timings.Total, 0.0)
+
+	page := get("/"+upstream.URL+"/page", "overlay")
+	assert.Contains(t, page, "<p>news news</p>")
+	assert.Contains(t, page, `<div id="ladder-debug"`)
+	assert.Contains(t, page, ".ad &rarr; 2 elements")
+	assert.Contains(t, page, "rewrite ")
+	assert.NotContains(t, page, "rewrite 0 ms")
+}
@@ -2,9 +2,10 @@ package handlers
 
 import (
 	_ "embed"
-	"log"
 	"os"
 
+	"github.com/andesco/ladder/pkg/logging"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -20,7 +21,7 @@ func Form(c *fiber.Ctx) error {
 		if os.Getenv("FORM_PATH") != "" {
 			dat, err := os.ReadFile(os.Getenv("FORM_PATH"))
 			if err != nil {
-				log.Println("ERROR: unable to load custom form", err)
+				requestLogger(c).Error("unable to load custom form", "path", os.Getenv("FORM_PATH"), logging.Err(err))
 			} else {
 				formHtml = string(dat)
 			}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+)
+
+var (
+	// forwardHeaders is the allowlist of upstream response headers that are sent to the client.
+	// "*" forwards every header that is not blocked.
+	forwardHeaders = getenvList("FORWARD_HEADERS", []string{
+		"Content-Type",
+		"Content-Security-Policy",
+		"Content-Disposition",
+		"Content-Language",
+		"Cache-Control",
+		"Expires",
+		"ETag",
+		"Last-Modified",
+		"Location",
+		"X-Ladder-Cache",
+		"X-Ladder-Strategy",
+	})
+
+	// blockHeaders is the denylist of upstream response headers. It takes precedence over forwardHeaders.
+	blockHeaders = getenvList("BLOCK_HEADERS", []string{
+		"Set-Cookie",
+		"Strict-Transport-Security",
+		"Alt-Svc",
+	})
+
+	// hopHeaders describe the upstream connection and the upstream body encoding,
+	// neither of which apply to the response sent to the client. They are never forwarded.
+	hopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Connection",
+		"Transfer-Encoding",
+		"Upgrade",
+		"Trailer",
+		"Content-Length",
+		"Content-Encoding",
+	}
+)
+
+// forwardedHeaders returns the upstream response headers that pass the forwarding policy,
+// and the headers set or added by the rule's response header operations.
+// Location headers are rewritten to their proxied form, so that redirects stay within ladder.
+func forwardedHeaders(resp *http.Response, ops ruleset.HeaderOps) http.Header {
+	header := http.Header{}
+
+	for key, values := range resp.Header {
+		if !headerForwarded(key) {
+			continue
+		}
+		header[key] = values
+	}
+
+	for _, key := range ops.Modified() {
+		if values := resp.Header.Values(key); len(values) > 0 && !headerIn(key, hopHeaders) {
+			header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+
+	if location := header.Get("Location"); location != "" && resp.Request != nil {
+		if proxied, ok := proxyURL(resp.Request.URL, location); ok {
+			header.Set("Location", proxied)
+		}
+	}
+
+	return header
+}
+
+// headerForwarded reports whether the policy allows an upstream response header to be sent to the client.
+func headerForwarded(key string) bool {
+	if headerIn(key, hopHeaders) || headerIn(key, blockHeaders) {
+		return false
+	}
+	return stringIn("*", forwardHeaders) || headerIn(key, forwardHeaders)
+}
+
+func headerIn(key string, list []string) bool {
+	for _, x := range list {
+		if strings.EqualFold(key, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// getenvList returns the comma separated list in the environment variable key, or fallback if it is unset.
+// An empty value results in an empty list.
+func getenvList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	list := []string{}
+	for _, x := range strings.Split(value, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	return list
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxySitePropagatesStatusAndHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/new-location?a=1", http.StatusMovedPermanently)
+		case "/missing":
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "not found")
+		default:
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("Content-Disposition", `attachment; filename="a.pdf"`)
+			w.Header().Set("Set-Cookie", "session=1")
+			w.Header().Set("X-Internal", "secret")
+			io.WriteString(w, "%PDF-1.4")
+		}
+	}))
+	defer upstream.Close()
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/moved", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "/"+upstream.URL+"/new-location?a=1", resp.Header.Get("Location"))
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/missing", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/a.pdf", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, `"abc"`, resp.Header.Get("ETag"))
+	assert.Equal(t, `attachment; filename="a.pdf"`, resp.Header.Get("Content-Disposition"))
+	assert.NotContains(t, resp.Header.Get("Set-Cookie"), "session=1")
+	assert.Empty(t, resp.Header.Get("X-Internal"))
+}
+
+func TestHeaderForwarded(t *testing.T) {
+	defer func(allow, block []string) {
+		forwardHeaders, blockHeaders = allow, block
+	}(forwardHeaders, blockHeaders)
+
+	forwardHeaders = []string{"*"}
+	blockHeaders = []string{"x-frame-options"}
+
+	assert.True(t, headerForwarded("X-Anything"))
+	assert.False(t, headerForwarded("X-Frame-Options"))
+	assert.False(t, headerForwarded("Transfer-Encoding"))
+	assert.False(t, headerForwarded("Content-Length"))
+}
+
+func TestProxySiteRuleHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Accept-Language", r.Header.Get("Accept-Language"))
+		w.Header().Set("X-Referer", r.Header.Get("Referer"))
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+
+	defer rules.Store(rules.Load())
+	useRuleset(ruleset.RuleSet{{
+		Domain: u.Host,
+		RequestHeaders: ruleset.HeaderOps{
+			Set:    map[string]string{"Authorization": "Bearer token", "Referer": "none"},
+			Add:    map[string]string{"Accept-Language": "en"},
+			Delete: []string{"X-Forwarded-For"},
+		},
+		ResponseHeaders: ruleset.HeaderOps{
+			Set:    map[string]string{"X-Robots-Tag": "noindex", "X-Echo": "1"},
+			Add:    map[string]string{"X-Echo": "2"},
+			Delete: []string{"X-Frame-Options"},
+		},
+	}})
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/page", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "noindex", resp.Header.Get("X-Robots-Tag"))
+	assert.Equal(t, []string{"1", "2"}, resp.Header.Values("X-Echo"))
+	assert.Empty(t, resp.Header.Get("X-Frame-Options"))
+
+	// the upstream echo headers are not allowed by the forwarding policy, check them on the fetch
+	_, upstreamResp := fetchString(t, upstream.URL+"/page")
+	assert.Equal(t, "Bearer token", upstreamResp.Header.Get("X-Authorization"))
+	assert.Equal(t, "en", upstreamResp.Header.Get("X-Accept-Language"))
+	assert.Empty(t, upstreamResp.Header.Get("X-Referer"))
+}
+
+func TestProxySiteRuleAcceptEncoding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			io.WriteString(w, "plain")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, "compressed")
+		gz.Close()
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+
+	defer rules.Store(rules.Load())
+	useRuleset(ruleset.RuleSet{{
+		Domain:         u.Host,
+		RequestHeaders: ruleset.HeaderOps{Set: map[string]string{"Accept-Encoding": "gzip"}},
+	}})
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	// the body is decompressed by ladder, as it is sent without Content-Encoding
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/page", nil))
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "compressed", string(body))
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// readyCheckURL is fetched through ladder regularly, /readyz fails while it cannot be fetched
+	readyCheckURL = os.Getenv("READY_CHECK_URL")
+	// readyCheckInterval is the interval readyCheckURL is fetched at
+	readyCheckInterval = getenvDuration("READY_CHECK_INTERVAL", time.Minute)
+
+	rulesetState = &rulesetHealth{}
+)
+
+// rulesetHealth is the state of the ruleset that WatchRuleset loads.
+type rulesetHealth struct {
+	mu sync.Mutex
+	// watching is true once the ruleset was checked for the first time
+	watching bool
+	// pending are the files and URLs of the rulesets that have not loaded yet. Rulesets that
+	// fail to reload later keep their previous rules, so ladder stays ready.
+	pending []string
+	// err is the error of the last check
+	err error
+}
+
+// checked records the result of a check of the ruleset, and the rulesets that have not loaded yet.
+func (h *rulesetHealth) checked(err error, pending []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watching = true
+	h.pending = pending
+	h.err = err
+}
+
+// status returns the state of the ruleset for /readyz, and whether ladder can serve requests with it.
+func (h *rulesetHealth) status() (string, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case !h.watching:
+		return "none", true, nil
+	case len(h.pending) == 0:
+		return "loaded", true, h.err
+	case h.err != nil:
+		return "failed", false, h.err
+	default:
+		// a file that failed to load is only reported by the check after it changed
+		return "failed", false, fmt.Errorf("rulesets not loaded: %s", strings.Join(h.pending, ", "))
+	}
+}
+
+// selfTest is the result of the last fetch of readyCheckURL.
+type selfTest struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// run fetches target through ladder and records whether it succeeded.
+func (t *selfTest) run(target string) {
+	res, err := fetchSite(target, nil, fetchOptions{followRedirects: true})
+	if err == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if err == nil && res.Response.StatusCode >= 400 {
+			err = fmt.Errorf("%s returned %s", target, res.Response.Status)
+		}
+	}
+	if err != nil {
+		slog.Warn("ready check failed", logging.Private("url", target), logging.Err(err))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checkedAt = time.Now()
+	t.err = err
+}
+
+// status returns the state of the self test for /readyz, and whether it passed.
+func (t *selfTest) status() (string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.checkedAt.IsZero():
+		return "pending", false, nil
+	case t.err != nil:
+		return "failed", false, t.err
+	default:
+		return "ok", true, nil
+	}
+}
+
+// Healthz answers liveness probes. It succeeds as long as ladder serves requests.
+func Healthz(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// Readiness is the response of /readyz.
+type Readiness struct {
+	Ready bool `json:"ready"`
+	// Ruleset is none if no ruleset is configured, loaded once every ruleset loaded at least once, or failed
+	Ruleset string `json:"ruleset"`
+	// SelfTest is the result of fetching READY_CHECK_URL: pending, ok or failed. It is empty if READY_CHECK_URL is not set.
+	SelfTest string   `json:"selfTest,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Readyz answers readiness probes. It fails until every ruleset has loaded once, and while READY_CHECK_URL,
+// if it is set, cannot be fetched. READY_CHECK_URL is fetched in the background every READY_CHECK_INTERVAL.
+func Readyz() fiber.Handler {
+	var test *selfTest
+	if readyCheckURL != "" {
+		test = &selfTest{}
+		go func() {
+			for {
+				test.run(readyCheckURL)
+				time.Sleep(readyCheckInterval)
+			}
+		}()
+	}
+
+	return func(c *fiber.Ctx) error {
+		return readiness(c, test)
+	}
+}
+
+func readiness(c *fiber.Ctx, test *selfTest) error {
+	var r Readiness
+	var err error
+
+	r.Ruleset, r.Ready, err = rulesetState.status()
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+
+	if test != nil {
+		var ok bool
+		r.SelfTest, ok, err = test.status()
+		r.Ready = r.Ready && ok
+		if err != nil {
+			r.Errors = append(r.Errors, err.Error())
+		}
+	}
+
+	if !r.Ready {
+		c.Status(fiber.StatusServiceUnavailable)
+	}
+	return c.JSON(r)
+}
+
+// VersionInfo is the response of /version.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	// Revision is the commit ladder was built from, and Modified tells whether it had uncommitted changes
+	Revision string `json:"revision,omitempty"`
+	Modified bool   `json:"modified,omitempty"`
+	// Time is the time of the commit
+	Time string `json:"time,omitempty"`
+}
+
+var versionInfo = readVersionInfo()
+
+func readVersionInfo() VersionInfo {
+	v := VersionInfo{Version: strings.TrimSpace(version)}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+
+	v.GoVersion = info.GoVersion
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.time":
+			v.Time = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+// Version returns the version of ladder, from the embedded VERSION, and details of the build.
+func Version(c *fiber.Ctx) error {
+	return c.JSON(versionInfo)
+}
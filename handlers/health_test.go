@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	defer rules.Store(rules.Load())
+	defer func(state *rulesetHealth) { rulesetState = state }(rulesetState)
+
+	upstreamStatus := http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(upstreamStatus)
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	useRuleset(ruleset.RuleSet{})
+
+	test := &selfTest{}
+	app := fiber.New()
+	app.Get("/healthz", Healthz)
+	app.Get("/readyz", func(c *fiber.Ctx) error { return readiness(c, nil) })
+	app.Get("/readyz/selftest", func(c *fiber.Ctx) error { return readiness(c, test) })
+
+	get := func(path string) (int, Readiness) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.NoError(t, err)
+		var r Readiness
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r
+	}
+
+	status, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+
+	// no ruleset configured
+	rulesetState = &rulesetHealth{}
+	status, r := get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, Readiness{Ready: true, Ruleset: "none"}, r)
+
+	rulesetState.checked(errors.New("failed to load rules"), []string{"rules.yaml"})
+	status, r = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, Readiness{Ready: false, Ruleset: "failed", Errors: []string{"failed to load rules"}}, r)
+
+	// later checks of the unchanged file do not report its error, it is still not loaded
+	rulesetState.checked(nil, []string{"rules.yaml"})
+	status, r = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, Readiness{Ready: false, Ruleset: "failed", Errors: []string{"rulesets not loaded: rules.yaml"}}, r)
+
+	rulesetState.checked(nil, nil)
+	status, r = get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, Readiness{Ready: true, Ruleset: "loaded"}, r)
+
+	// a failed reload keeps the previous rules
+	rulesetState.checked(errors.New("failed to reload rules"), nil)
+	status, r = get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, Readiness{Ready: true, Ruleset: "loaded", Errors: []string{"failed to reload rules"}}, r)
+
+	status, r = get("/readyz/selftest")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "pending", r.SelfTest)
+
+	test.run(upstream.URL + "/check")
+	status, r = get("/readyz/selftest")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", r.SelfTest)
+
+	upstreamStatus = http.StatusBadGateway
+	test.run(upstream.URL + "/check")
+	status, r = get("/readyz/selftest")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "failed", r.SelfTest)
+	assert.Contains(t, r.Errors, upstream.URL+"/check returned 502 Bad Gateway")
+}
+
+func TestVersion(t *testing.T) {
+	app := fiber.New()
+	app.Get("/version", Version)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.NoError(t, err)
+
+	var v VersionInfo
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+	assert.NotEmpty(t, v.Version)
+	assert.NotEmpty(t, v.GoVersion)
+}
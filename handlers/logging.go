@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// requestIDKey is the key of the request ID in the locals of a request.
+type requestIDKey struct{}
+
+// LogRequests gives every request an ID, which is sent back in the X-Request-ID header and logged
+// with everything the request logs. A request ID sent by the client is kept. When the request is
+// done, its method, path, status, size and duration are logged.
+func LogRequests() fiber.Handler {
+	// UUIDv4 does not reveal the number of requests, like the default generator does
+	setID := requestid.New(requestid.Config{Generator: utils.UUIDv4, ContextKey: requestIDKey{}})
+
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := setID(c)
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var e *fiber.Error
+			if errors.As(err, &e) {
+				status = e.Code
+			}
+		}
+
+		attrs := []any{
+			"method", c.Method(),
+			logging.Private("path", c.Path()),
+			"status", status,
+			"duration", time.Since(start),
+		}
+		// streamed bodies are only counted if their size is known
+		if !c.Response().IsBodyStream() {
+			attrs = append(attrs, "bytes", len(c.Response().Body()))
+		} else if n := c.Response().Header.ContentLength(); n >= 0 {
+			attrs = append(attrs, "bytes", n)
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case c.Path() == "/healthz" || c.Path() == "/readyz":
+			// probes would drown everything else
+			level = slog.LevelDebug
+		case status >= 500:
+			level = slog.LevelWarn
+		}
+		requestLogger(c).Log(c.Context(), level, "request", attrs...)
+
+		return err
+	}
+}
+
+// requestLogger returns the logger for c, which adds the ID of the request.
+func requestLogger(c *fiber.Ctx) *slog.Logger {
+	if id, ok := c.Locals(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
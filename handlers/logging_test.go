@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/logging"
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRequests(t *testing.T) {
+	defer rules.Store(rules.Load())
+	defer slog.SetDefault(slog.Default())
+	defer logging.SetURLMode(logging.SetURLMode(logging.URLsShown))
+
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	useRuleset(ruleset.RuleSet{{Domain: "127.0.0.1"}})
+
+	app := fiber.New()
+	app.Use(LogRequests())
+	app.Get("/raw/*", Raw)
+
+	req := httptest.NewRequest(http.MethodGet, "/raw/"+upstream.URL+"/page", nil)
+	req.Header.Set("X-Request-ID", "abc")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", resp.Header.Get("X-Request-ID"))
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/raw/"+upstream.URL+"/other", nil))
+	assert.NoError(t, err)
+	assert.Len(t, resp.Header.Get("X-Request-ID"), 36)
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(&logs)
+	for scanner.Scan() {
+		var record map[string]any
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+
+	assert.Len(t, records, 4)
+	fetched, request := records[0], records[1]
+
+	assert.Equal(t, "fetched", fetched["msg"])
+	assert.Equal(t, "abc", fetched["request_id"])
+	assert.Equal(t, upstream.URL+"/page", fetched["url"])
+	assert.Equal(t, upstream.Listener.Addr().String(), fetched["host"])
+	assert.Equal(t, "127.0.0.1", fetched["rule"])
+	assert.Equal(t, 200.0, fetched["status"])
+	assert.Contains(t, fetched, "duration")
+
+	assert.Equal(t, "request", request["msg"])
+	assert.Equal(t, "INFO", request["level"])
+	assert.Equal(t, "abc", request["request_id"])
+	assert.Equal(t, "GET", request["method"])
+	assert.Equal(t, "/raw/"+upstream.URL+"/page", request["path"])
+	assert.Equal(t, 200.0, request["status"])
+	assert.Equal(t, 5.0, request["bytes"])
+	assert.Contains(t, request, "duration")
+
+	assert.Equal(t, resp.Header.Get("X-Request-ID"), records[3]["request_id"])
+}
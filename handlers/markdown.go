@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	xhtml "golang.org/x/net/html"
+)
+
+// formats are the output formats of Raw and Api, selected with the format query parameter.
+// html is the rewritten page, markdown and text are the extracted article.
+var formats = map[string]string{
+	"html":     "text/html; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+	"text":     "text/plain; charset=utf-8",
+}
+
+// outputFormat takes the format parameter out of queries, so that it is not sent to the site.
+// Values that are not a known format are left for the site. It returns "html" by default.
+func outputFormat(queries map[string]string) string {
+	format := strings.ToLower(queries["format"])
+	if _, ok := formats[format]; !ok {
+		return "html"
+	}
+	delete(queries, "format")
+	return format
+}
+
+// errNotHTML is returned for pages that an article cannot be extracted from.
+var errNotHTML = errors.New("only HTML pages can be converted to markdown or text")
+
+// renderArticle extracts the article from the rewritten HTML page in body and renders it as markdown or text.
+// Links and images point to the sites, not to ladder, so that the output can be used anywhere.
+func renderArticle(body io.Reader, resp *http.Response, format string) (string, error) {
+	if processorFor(resp.Header.Get("Content-Type")) != "html" {
+		return "", errNotHTML
+	}
+
+	doc, err := goquery.NewDocumentFromReader(body)
+	if err != nil {
+		return "", err
+	}
+
+	a := extractArticle(doc, resp.Request.URL)
+
+	content, err := xhtml.Parse(strings.NewReader("<div>" + a.Content + "</div>"))
+	if err != nil {
+		return "", err
+	}
+
+	w := &markdownWriter{plain: format == "text"}
+
+	if a.Title != "" {
+		w.block()
+		if !w.plain {
+			w.write("# ")
+		}
+		w.write(a.Title)
+	}
+
+	var meta []string
+	for _, s := range []string{a.Byline, a.Date()} {
+		if s != "" {
+			meta = append(meta, s)
+		}
+	}
+	if len(meta) > 0 {
+		w.block()
+		if w.plain {
+			w.write(strings.Join(meta, " · "))
+		} else {
+			w.write("*" + escapeMarkdown(strings.Join(meta, " · ")) + "*")
+		}
+	}
+
+	if a.Image != "" && !w.plain {
+		w.block()
+		w.write("![](" + siteURL(a.Image) + ")")
+	}
+
+	w.children(content)
+
+	return strings.TrimSpace(w.b.String()) + "\n", nil
+}
+
+// markdownWriter converts HTML to markdown, or to plain text if plain is set.
+type markdownWriter struct {
+	b     strings.Builder
+	plain bool
+	// prefix starts every line, for blockquotes and list items
+	prefix string
+	// pre keeps whitespace
+	pre bool
+	// atLineStart is true when nothing but the prefix was written on the current line
+	atLineStart bool
+	// pendingBlock requests a blank line before the next text
+	pendingBlock bool
+	// blockPrefix is the prefix when the blank line was requested
+	blockPrefix string
+	// lists holds the next number of each ordered list, or 0 for unordered lists
+	lists []int
+}
+
+// block starts a new paragraph.
+func (w *markdownWriter) block() {
+	if w.b.Len() > 0 && !w.pendingBlock && !w.atLineStart {
+		w.pendingBlock = true
+		w.blockPrefix = w.prefix
+	}
+}
+
+// newline ends the current line.
+func (w *markdownWriter) newline() {
+	w.b.WriteString("\n" + w.prefix)
+	w.atLineStart = true
+}
+
+func (w *markdownWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.pendingBlock {
+		w.pendingBlock = false
+		w.b.WriteString("\n" + strings.TrimRight(w.blockPrefix, " ") + "\n" + w.prefix)
+		w.atLineStart = true
+	}
+	w.b.WriteString(s)
+	w.atLineStart = false
+}
+
+// text writes the text of a node, with whitespace collapsed unless it is preformatted.
+func (w *markdownWriter) text(s string) {
+	if w.pre {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.newline()
+			}
+			w.write(line)
+		}
+		return
+	}
+
+	collapsed := strings.Join(strings.Fields(s), " ")
+	if collapsed == "" {
+		if s != "" && !w.atLineStart && !w.pendingBlock && !strings.HasSuffix(w.b.String(), " ") {
+			w.b.WriteString(" ")
+		}
+		return
+	}
+	if s[0] == ' ' || s[0] == '\n' || s[0] == '\t' {
+		if !w.atLineStart && !w.pendingBlock && !strings.HasSuffix(w.b.String(), " ") {
+			w.b.WriteString(" ")
+		}
+	}
+	if !w.plain {
+		collapsed = escapeMarkdown(collapsed)
+	}
+	w.write(collapsed)
+	if last := s[len(s)-1]; last == ' ' || last == '\n' || last == '\t' {
+		w.b.WriteString(" ")
+	}
+}
+
+func (w *markdownWriter) children(n *xhtml.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *markdownWriter) node(n *xhtml.Node) {
+	switch n.Type {
+	case xhtml.TextNode:
+		w.text(n.Data)
+		return
+	case xhtml.ElementNode:
+	default:
+		w.children(n)
+		return
+	}
+
+	switch n.Data {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		w.block()
+		if !w.plain {
+			w.write(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		}
+		w.inline(n)
+		w.block()
+
+	case "p", "div", "section", "article", "figure", "header", "main", "dl":
+		w.block()
+		w.children(n)
+		w.block()
+
+	case "figcaption", "dt", "dd":
+		w.block()
+		if !w.plain && n.Data == "figcaption" {
+			w.write("*")
+			w.inline(n)
+			w.write("*")
+		} else {
+			w.inline(n)
+		}
+		w.block()
+
+	case "br":
+		w.newline()
+
+	case "hr":
+		w.block()
+		if !w.plain {
+			w.write("---")
+		}
+		w.block()
+
+	case "blockquote":
+		w.block()
+		prefix := w.prefix
+		if w.plain {
+			w.prefix += "  "
+		} else {
+			w.prefix += "> "
+		}
+		if w.b.Len() == 0 {
+			w.b.WriteString(w.prefix)
+			w.atLineStart = true
+		}
+		w.children(n)
+		w.prefix = prefix
+		// the blank line after the quote is outside of it
+		w.pendingBlock = false
+		w.block()
+
+	case "pre":
+		w.block()
+		if !w.plain {
+			w.write("```")
+			w.newline()
+		}
+		w.pre = true
+		w.write(strings.TrimRight(textContent(n), "\n"))
+		w.pre = false
+		if !w.plain {
+			w.newline()
+			w.write("```")
+		}
+		w.block()
+
+	case "ul", "ol":
+		if len(w.lists) == 0 {
+			w.block()
+		}
+		start := 0
+		if n.Data == "ol" {
+			start = 1
+		}
+		w.lists = append(w.lists, start)
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		if len(w.lists) == 0 {
+			w.block()
+		}
+
+	case "li":
+		marker := "- "
+		if len(w.lists) > 0 && w.lists[len(w.lists)-1] > 0 {
+			marker = fmt.Sprintf("%d. ", w.lists[len(w.lists)-1])
+			w.lists[len(w.lists)-1]++
+		}
+		if !w.pendingBlock && w.b.Len() > 0 {
+			w.newline()
+		}
+		w.write(marker)
+		w.atLineStart = true
+		prefix := w.prefix
+		w.prefix += strings.Repeat(" ", len(marker))
+		w.inline(n)
+		w.prefix = prefix
+		w.pendingBlock = false
+
+	case "table":
+		w.block()
+		w.table(n)
+		w.block()
+
+	case "img":
+		src := siteURL(attr(n, "src"))
+		if w.plain || src == "" {
+			return
+		}
+		w.write("![" + escapeMarkdown(attr(n, "alt")) + "](" + src + ")")
+
+	case "a":
+		href := siteURL(attr(n, "href"))
+		if w.plain || href == "" || strings.HasPrefix(href, "#") {
+			w.children(n)
+			return
+		}
+		w.write("[")
+		w.atLineStart = false
+		w.inline(n)
+		w.b.WriteString("](" + href + ")")
+
+	case "strong", "b":
+		w.wrap(n, "**")
+
+	case "em", "i":
+		w.wrap(n, "*")
+
+	case "code":
+		if w.plain {
+			w.children(n)
+			return
+		}
+		w.write("`" + textContent(n) + "`")
+
+	default:
+		w.children(n)
+	}
+}
+
+// inline writes the children of n, with block elements kept inline as far as possible.
+func (w *markdownWriter) inline(n *xhtml.Node) {
+	w.children(n)
+	w.pendingBlock = false
+}
+
+// wrap writes the children of n between delimiter, for emphasis.
+func (w *markdownWriter) wrap(n *xhtml.Node, delimiter string) {
+	text := strings.TrimSpace(textContent(n))
+	if w.plain || text == "" {
+		w.children(n)
+		return
+	}
+	w.write(delimiter)
+	w.inline(n)
+	w.b.WriteString(delimiter)
+}
+
+// table writes a table as a GitHub flavored markdown table, or as tab separated lines in plain text.
+func (w *markdownWriter) table(n *xhtml.Node) {
+	var rows [][]string
+	var walk func(*xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != xhtml.ElementNode {
+				continue
+			}
+			if c.Data != "tr" {
+				walk(c)
+				continue
+			}
+			var row []string
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == xhtml.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+					cw := &markdownWriter{plain: w.plain}
+					cw.children(cell)
+					text := strings.Join(strings.Fields(cw.b.String()), " ")
+					if !w.plain {
+						text = strings.ReplaceAll(text, "|", `\|`)
+					}
+					row = append(row, text)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	walk(n)
+
+	if len(rows) == 0 {
+		return
+	}
+
+	if w.plain {
+		for i, row := range rows {
+			if i > 0 {
+				w.newline()
+			}
+			w.write(strings.Join(row, "\t"))
+		}
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		if i > 0 {
+			w.newline()
+		}
+		w.write("| " + strings.Join(row, " | ") + " |")
+		if i == 0 {
+			w.newline()
+			w.write("|" + strings.Repeat(" --- |", columns))
+		}
+	}
+}
+
+// siteURL returns the URL of the site for a proxied URL, e.g. https://example.com/ for /https://example.com/.
+func siteURL(ref string) string {
+	if strings.HasPrefix(ref, "/http://") || strings.HasPrefix(ref, "/https://") {
+		return ref[1:]
+	}
+	return ref
+}
+
+func attr(n *xhtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *xhtml.Node) string {
+	var b strings.Builder
+	var walk func(*xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`)
+
+// escapeMarkdown escapes the characters of text that markdown would take for formatting.
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
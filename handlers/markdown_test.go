@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const markdownPage = `<html><head><title>Guide</title>
+<meta name="author" content="Jane Doe">
+<meta property="article:published_time" content="2023-11-01">
+</head><body><article class="post-content">
+<h1>Guide</h1>
+<p>An <strong>important</strong> guide, with <a href="/docs">links</a> and <em>emphasis</em>, to test the conversion.</p>
+<h2>Steps</h2>
+<ol><li>First step</li><li>Second step<ul><li>Detail</li></ul></li></ol>
+<blockquote><p>A quote, with some text, to keep it in the article.</p></blockquote>
+<table><tr><th>Name</th><th>Value</th></tr><tr><td>a|b</td><td>1</td></tr></table>
+<p><img src="/img/chart.png" alt="Chart"></p>
+<pre>line 1
+  line 2</pre>
+<p>A final paragraph with 1_000 *stars* in it, and more text to be long enough.</p>
+</article></body></html>`
+
+const expectedMarkdown = "# Guide\n\n" +
+	"*Jane Doe · November 1, 2023*\n\n" +
+	"An **important** guide, with [links](%[1]s/docs) and *emphasis*, to test the conversion.\n\n" +
+	"## Steps\n\n" +
+	"1. First step\n" +
+	"2. Second step\n" +
+	"   - Detail\n\n" +
+	"> A quote, with some text, to keep it in the article.\n\n" +
+	"| Name | Value |\n" +
+	"| --- | --- |\n" +
+	"| a\\|b | 1 |\n\n" +
+	"![Chart](%[1]s/img/chart.png)\n\n" +
+	"```\n" +
+	"line 1\n" +
+	"  line 2\n" +
+	"```\n\n" +
+	"A final paragraph with 1\\_000 \\*stars\\* in it, and more text to be long enough.\n"
+
+const expectedText = "Guide\n\n" +
+	"Jane Doe · November 1, 2023\n\n" +
+	"An important guide, with links and emphasis, to test the conversion.\n\n" +
+	"Steps\n\n" +
+	"1. First step\n" +
+	"2. Second step\n" +
+	"   - Detail\n\n" +
+	"  A quote, with some text, to keep it in the article.\n\n" +
+	"Name\tValue\n" +
+	"a|b\t1\n\n" +
+	"line 1\n" +
+	"  line 2\n\n" +
+	"A final paragraph with 1_000 *stars* in it, and more text to be long enough.\n"
+
+func TestOutputFormats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("format"))
+		if r.URL.Path == "/data.json" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, markdownPage)
+	}))
+	defer upstream.Close()
+
+	app := fiber.New()
+	app.Get("/raw/*", Raw)
+	app.Get("/api/*", Api)
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("/raw/" + upstream.URL + "/guide?format=markdown")
+	assert.Equal(t, "text/markdown; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf(expectedMarkdown, upstream.URL), body)
+
+	resp, body = get("/raw/" + upstream.URL + "/guide?format=text")
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, expectedText, body)
+
+	_, body = get("/raw/" + upstream.URL + "/guide?format=html")
+	assert.Contains(t, body, `<a href="/`+upstream.URL+`/docs">`)
+
+	resp, _ = get("/raw/" + upstream.URL + "/data.json?format=markdown")
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	_, body = get("/api/" + upstream.URL + "/guide?format=markdown")
+	var response Response
+	assert.NoError(t, json.Unmarshal([]byte(body), &response))
+	assert.Equal(t, "markdown", response.Format)
+	assert.Equal(t, fmt.Sprintf(expectedMarkdown, upstream.URL), response.Body)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// metricsToken is the bearer token required by /metrics, which is disabled if it is empty
+	metricsToken = os.Getenv("METRICS_TOKEN")
+
+	metricsRegistry = prometheus.NewRegistry()
+
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ladder_upstream_requests_total",
+		Help: "Requests to sites by rule domain and status class (2xx, 3xx, 4xx, 5xx), or error if no response arrived.",
+	}, []string{"domain", "status"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ladder_upstream_duration_seconds",
+		Help:    "Time until the response headers of a site arrived, including redirects and failed strategies.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"domain"})
+
+	proxiedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ladder_proxied_bytes_total",
+		Help: "Bytes of rewritten response bodies sent to clients, by domain.",
+	}, []string{"domain"})
+
+	ruleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ladder_rule_matches_total",
+		Help: "Requests a rule was applied to, by the domains or name of the rule.",
+	}, []string{"rule"})
+
+	rewriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ladder_rewrite_duration_seconds",
+		Help:    "Time it took to read and rewrite response bodies, by processor.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"processor"})
+
+	rulesetReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ladder_ruleset_reloads_total",
+		Help: "Ruleset loads by result, success or failure.",
+	}, []string{"result"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ladder_cache_lookups_total",
+		Help: "Cache lookups by result: hit, revalidated or miss.",
+	}, []string{"result"})
+
+	// cacheHits and cacheTotal count the same lookups as cacheLookups, for the hit ratio
+	cacheHits, cacheTotal atomic.Int64
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		upstreamRequests,
+		upstreamDuration,
+		proxiedBytes,
+		ruleMatches,
+		rewriteDuration,
+		rulesetReloads,
+		cacheLookups,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ladder_cache_hit_ratio",
+			Help: "Share of cache lookups since the start that were served from the cache, fresh or revalidated.",
+		}, func() float64 {
+			total := cacheTotal.Load()
+			if total == 0 {
+				return 0
+			}
+			return float64(cacheHits.Load()) / float64(total)
+		}),
+	)
+}
+
+// Metrics serves the metrics of ladder in the Prometheus text format. It is disabled unless METRICS_TOKEN is set,
+// and requests need to authenticate with `Authorization: Bearer <token>`. USERPASS does not apply to it.
+func Metrics() fiber.Handler {
+	serve := adaptor.HTTPHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	return func(c *fiber.Ctx) error {
+		if metricsToken == "" {
+			c.SendStatus(fiber.StatusNotFound)
+			return c.SendString("Metrics Disabled")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(c.Get("Authorization")), []byte("Bearer "+metricsToken)) != 1 {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return c.SendString("Unauthorized")
+		}
+
+		return serve(c)
+	}
+}
+
+// metricsDomain returns the domain label of requests to host with rule: the domain of the rule, or "other"
+// if no rule for the host applied. Hosts are chosen by the clients of ladder, labeling with them would let
+// anyone create any number of series.
+func metricsDomain(host string, rule ruleset.Rule) string {
+	if domain, ok := rule.DomainOf(host); ok {
+		return domain
+	}
+	return "other"
+}
+
+// statusClass returns the class of an HTTP status code, e.g. 4xx for 404.
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return strconv.Itoa(code)
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// observeCache counts a cache lookup with the given result.
+func observeCache(result string) {
+	cacheLookups.WithLabelValues(result).Inc()
+	cacheTotal.Add(1)
+	if result != "miss" {
+		cacheHits.Add(1)
+	}
+}
+
+// observeRewrite records the time since start as the duration of a rewrite by processor.
+func observeRewrite(processor string, start time.Time) {
+	rewriteDuration.WithLabelValues(processor).Observe(time.Since(start).Seconds())
+}
+
+// countingBody counts the bytes read from a response body as proxied bytes of domain.
+type countingBody struct {
+	io.ReadCloser
+	bytes prometheus.Counter
+}
+
+func newCountingBody(body io.ReadCloser, domain string) countingBody {
+	return countingBody{ReadCloser: body, bytes: proxiedBytes.WithLabelValues(domain)}
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	defer rules.Store(rules.Load())
+	defer func(token string) { metricsToken = token }(metricsToken)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><body><p>hello</p></body></html>`)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	useRuleset(ruleset.RuleSet{{Domain: u.Hostname(), Paths: []string{"/page"}}})
+
+	app := fiber.New()
+	app.Get("metrics", Metrics())
+	app.Get("raw/*", Raw)
+
+	get := func(path string, token string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	get("/raw/"+upstream.URL+"/page", "")
+	get("/raw/"+upstream.URL+"/missing", "")
+
+	metricsToken = ""
+	status, _ := get("/metrics", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	metricsToken = "secret"
+	status, _ = get("/metrics", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = get("/metrics", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, body := get("/metrics", "secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `ladder_upstream_requests_total{domain="127.0.0.1",status="2xx"}`)
+	// no rule applies to /missing
+	assert.Contains(t, body, `ladder_upstream_requests_total{domain="other",status="4xx"}`)
+	assert.Contains(t, body, `ladder_upstream_duration_seconds_count{domain="127.0.0.1"}`)
+	assert.Contains(t, body, `ladder_proxied_bytes_total{domain="127.0.0.1"}`)
+	assert.Contains(t, body, `ladder_rule_matches_total{rule="127.0.0.1"}`)
+	assert.Contains(t, body, `ladder_rewrite_duration_seconds_count{processor="html"}`)
+	assert.Contains(t, body, `ladder_cache_hit_ratio`)
+	assert.Contains(t, body, `go_goroutines`)
+}
+
+func TestMetricsDomain(t *testing.T) {
+	rule := ruleset.Rule{Domain: "nytimes.com", Domains: []string{"*", "Example.org"}}
+
+	assert.Equal(t, "nytimes.com", metricsDomain("www.nytimes.com", rule))
+	assert.Equal(t, "example.org", metricsDomain("example.org:8080", rule))
+	assert.Equal(t, "other", metricsDomain("notnytimes.com", rule))
+	assert.Equal(t, "other", metricsDomain("random-1234.test", ruleset.Rule{Domain: "*"}))
+	assert.Equal(t, "other", metricsDomain("random-1234.test", ruleset.Rule{}))
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(200))
+	assert.Equal(t, "3xx", statusClass(304))
+	assert.Equal(t, "5xx", statusClass(503))
+	assert.Equal(t, "0", statusClass(0))
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+)
+
+// A processor transforms an upstream response body of a single kind of content.
+type processor func(w io.Writer, r io.Reader, u *url.URL, rule ruleset.Rule) error
+
+// processors maps the processor names that can be used in a rule's `processors`
+// list to their implementation. A nil processor passes the body through untouched.
+var processors = map[string]processor{
+	"html": rewriteHtml,
+	"css":  rewriteStylesheet,
+	"js":   nil,
+	"raw":  nil,
+}
+
+// processorFor returns the name of the processor responsible for a Content-Type.
+func processorFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "raw"
+	}
+
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return "html"
+	case mediaType == "text/css":
+		return "css"
+	case strings.HasSuffix(mediaType, "javascript") || strings.HasSuffix(mediaType, "ecmascript"):
+		return "js"
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return "js"
+	default:
+		return "raw"
+	}
+}
+
+// selectProcessor picks the processor for an upstream response. Responses without a
+// Content-Type are sniffed, which replaces resp.Body with a buffered reader.
+// If the rule restricts the processors in use, anything else is passed through.
+func selectProcessor(resp *http.Response, rule ruleset.Rule) (string, processor) {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		upstream := resp.Body
+		br := bufio.NewReader(upstream)
+		head, _ := br.Peek(512)
+		contentType = http.DetectContentType(head)
+		resp.Body = readCloser{br, upstream.Close}
+	}
+
+	name := processorFor(contentType)
+	if len(rule.Processors) > 0 && !stringIn(name, rule.Processors) {
+		name = "raw"
+	}
+
+	return name, processors[name]
+}
+
+// rewriteStylesheet rewrites the url() references and @import rules of a stylesheet.
+// Stylesheets are small compared to the pages and media they belong to, so they are
+// read into memory instead of being tokenized.
+func rewriteStylesheet(w io.Writer, r io.Reader, u *url.URL, _ ruleset.Rule) error {
+	css, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, rewriteCSS(string(css), normalizeBase(u)))
+	return err
+}
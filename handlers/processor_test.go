@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessorFor(t *testing.T) {
+	testCases := map[string]string{
+		"text/html; charset=utf-8": "html",
+		"application/xhtml+xml":    "html",
+		"text/css":                 "css",
+		"application/javascript":   "js",
+		"text/javascript":          "js",
+		"application/json":         "js",
+		"application/ld+json":      "js",
+		"image/jpeg":               "raw",
+		"font/woff2":               "raw",
+		"application/pdf":          "raw",
+		"not a content type;;":     "raw",
+	}
+
+	for contentType, expected := range testCases {
+		assert.Equal(t, expected, processorFor(contentType), contentType)
+	}
+}
+
+func fetchString(t *testing.T, target string) (string, *http.Response) {
+	t.Helper()
+
+	body, _, resp, err := FetchSite(target, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return string(b), resp
+}
+
+func TestFetchSiteDispatchesOnContentType(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			io.WriteString(w, `body { background: url(/bg.png) }`)
+		case "/data.json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"html": "<img src=\"/x.png\">"}`)
+		case "/sniffed":
+			w.Header()["Content-Type"] = nil
+			io.WriteString(w, `<!DOCTYPE html><img src="/x.png">`)
+		}
+	}))
+	defer upstream.Close()
+
+	body, _ := fetchString(t, upstream.URL+"/style.css")
+	assert.Equal(t, `body { background: url(/`+upstream.URL+`/bg.png) }`, body)
+
+	body, _ = fetchString(t, upstream.URL+"/data.json")
+	assert.Equal(t, `{"html": "<img src=\"/x.png\">"}`, body)
+
+	body, _ = fetchString(t, upstream.URL+"/sniffed")
+	assert.Equal(t, `<!DOCTYPE html><img src="/`+upstream.URL+`/x.png">`, body)
+}
+
+func TestRuleProcessors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<img src="/x.png">`)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+
+	defer rules.Store(rules.Load())
+	useRuleset(ruleset.RuleSet{{Domain: u.Host, Processors: []string{"css"}}})
+
+	body, _ := fetchString(t, upstream.URL+"/")
+	assert.Equal(t, `<img src="/x.png">`, body)
+}
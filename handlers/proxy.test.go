@@ -2,6 +2,7 @@
 package handlers
 
 import (
+	"bytes"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -46,15 +47,17 @@ func TestRewriteHtml(t *testing.T) {
 			</head>
 			<body>
 				<img src="/https://example.com/image.jpg">
-				<script script="/https://example.com/script.js"></script>
+				<script src="/https://example.com/script.js"></script>
 				<a href="/https://example.com/about">About Us</a>
 				<div style="background-image: url('/https://example.com/background.jpg')"></div>
 			</body>
 		</html>
 	`
 
-	actual := rewriteHtml(bodyB, u, ruleset.Rule{})
-	assert.Equal(t, expected, actual)
+	var actual bytes.Buffer
+	err := rewriteHtml(&actual, bytes.NewReader(bodyB), u, ruleset.Rule{})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual.String())
 }
 
 // END: 6f8b3f5d5d5d
@@ -1,17 +1,22 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/andesco/ladder/pkg/cache"
+	"github.com/andesco/ladder/pkg/logging"
 	"github.com/andesco/ladder/pkg/ruleset"
 
 	"github.com/PuerkitoBio/goquery"
@@ -20,19 +25,19 @@ import (
 var (
 	UserAgent      = getenv("USER_AGENT", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
 	ForwardedFor   = getenv("X_FORWARDED_FOR", "66.249.66.1")
-	rulesSet       = ruleset.NewRulesetFromEnv()
 	allowedDomains = []string{}
-	defaultTimeout = 15 // in seconds
+
+	// allowedDomainsRuleset adds the domains of the current ruleset to allowedDomains
+	allowedDomainsRuleset = os.Getenv("ALLOWED_DOMAINS_RULESET") == "true"
+
+	// rules is swapped as a whole when the ruleset is reloaded, requests keep the rule they started with
+	rules atomic.Pointer[ruleset.Matcher]
 )
 
 func init() {
+	// the ruleset is loaded by ProxySite, which keeps it up to date
+	rules.Store(ruleset.NewMatcher(nil))
 	allowedDomains = strings.Split(os.Getenv("ALLOWED_DOMAINS"), ",")
-	if os.Getenv("ALLOWED_DOMAINS_RULESET") == "true" {
-		allowedDomains = append(allowedDomains, rulesSet.Domains()...)
-	}
-	if timeoutStr := os.Getenv("HTTP_TIMEOUT"); timeoutStr != "" {
-		defaultTimeout, _ = strconv.Atoi(timeoutStr)
-	}
 }
 
 func modifyURL(uri string, rule ruleset.Rule) (string, error) {
@@ -42,12 +47,18 @@ func modifyURL(uri string, rule ruleset.Rule) (string, error) {
 	}
 
 	for _, urlMod := range rule.URLMods.Domain {
-		re := regexp.MustCompile(urlMod.Match)
+		re, err := urlMod.Regexp()
+		if err != nil {
+			return "", err
+		}
 		newUrl.Host = re.ReplaceAllString(newUrl.Host, urlMod.Replace)
 	}
 
 	for _, urlMod := range rule.URLMods.Path {
-		re := regexp.MustCompile(urlMod.Match)
+		re, err := urlMod.Regexp()
+		if err != nil {
+			return "", err
+		}
 		newUrl.Path = re.ReplaceAllString(newUrl.Path, urlMod.Replace)
 	}
 
@@ -71,41 +82,283 @@ func modifyURL(uri string, rule ruleset.Rule) (string, error) {
 	return newUrl.String(), nil
 }
 
-func FetchSite(urlpath string, queries map[string]string) (string, *http.Request, *http.Response, error) {
+// fetchOptions changes how fetchSite talks to the upstream server.
+type fetchOptions struct {
+	// followRedirects makes the client follow redirects. Otherwise the redirect response is returned.
+	followRedirects bool
+	// transport replaces the connection to the upstream server, and disables the cache
+	transport http.RoundTripper
+	// timings records the timings of the fetch, if it is set
+	timings *fetchTimings
+	// trace records the rule and its effects, if it is set
+	trace *fetchTrace
+	// logger logs with the ID of the request, if it is set
+	logger *slog.Logger
+}
+
+// log returns the logger for the fetch.
+func (opts fetchOptions) log() *slog.Logger {
+	if opts.logger != nil {
+		return opts.logger
+	}
+	return slog.Default()
+}
+
+// FetchSite fetches urlpath with the matching rule applied and returns the rewritten body as a stream.
+// Redirects are followed. The caller must close the returned body, which also releases the upstream connection.
+func FetchSite(urlpath string, queries map[string]string) (io.ReadCloser, *http.Request, *http.Response, error) {
+	res, err := fetchSite(urlpath, queries, fetchOptions{followRedirects: true})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return res.Body, res.Request, res.Response, nil
+}
+
+// fetchResult is the outcome of fetchSite.
+type fetchResult struct {
+	// Body is the rewritten response body
+	Body io.ReadCloser
+	// Request is the request sent to the upstream server
+	Request *http.Request
+	// Response is the upstream response, with the rule's response headers applied
+	Response *http.Response
+	// Rule is the rule that was applied
+	Rule ruleset.Rule
+	// Strategy is the name of the strategy that fetched the page, if the rule has strategies
+	Strategy string
+}
+
+func fetchSite(urlpath string, queries map[string]string, opts fetchOptions) (*fetchResult, error) {
+	start := time.Now()
+
+	// in the order of their names, so that the URL and its cache key are the same for every request
+	keys := make([]string, 0, len(queries))
+	for k := range queries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	urlQuery := "?"
-	if len(queries) > 0 {
-		for k, v := range queries {
-			urlQuery += k + "=" + v + "&"
-		}
+	for _, k := range keys {
+		urlQuery += k + "=" + queries[k] + "&"
 	}
 	urlQuery = strings.TrimSuffix(urlQuery, "&")
 	urlQuery = strings.TrimSuffix(urlQuery, "?")
 
 	u, err := url.Parse(urlpath)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
+	}
+
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+
+	// the same rules are used for the whole request, also if the ruleset is reloaded meanwhile
+	matcher := rules.Load()
+
+	allowed := allowedDomains
+	if allowedDomainsRuleset {
+		rs := matcher.Rules()
+		allowed = append(allowed[:len(allowed):len(allowed)], rs.Domains()...)
 	}
 
-	if len(allowedDomains) > 0 && !StringInSlice(u.Host, allowedDomains) {
-		return "", nil, nil, fmt.Errorf("domain not allowed. %s not in %s", u.Host, allowedDomains)
+	if len(allowed) > 0 && !StringInSlice(u.Host, allowed) {
+		return nil, fmt.Errorf("domain not allowed. %s not in %s", u.Host, allowed)
 	}
 
-	if os.Getenv("LOG_URLS") == "true" {
-		log.Println(u.String() + urlQuery)
+	var rule ruleset.Rule
+	if opts.trace != nil {
+		var explanation ruleset.Explanation
+		var ok bool
+		rule, explanation, ok = matcher.Explain(u.Host, u.Path)
+		opts.trace.match(rule, explanation, ok)
+	} else {
+		rule, _ = matcher.Match(u.Host, u.Path)
 	}
 
+	domain := metricsDomain(u.Hostname(), rule)
+
 	// Modify the URI according to ruleset
-	rule := fetchRule(u.Host, u.Path)
 	url, err := modifyURL(u.String()+urlQuery, rule)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
+	}
+
+	if opts.trace != nil {
+		opts.trace.URL = u.String() + urlQuery
+		opts.trace.ModifiedURL = url
+		if opts.timings == nil {
+			opts.timings = &opts.trace.timings
+		}
 	}
 
 	// Fetch the site
-	client := &http.Client{
-		Timeout: time.Second * time.Duration(defaultTimeout),
+	timeout := transportConfig.Timeout
+	if rule.Timeout != "" {
+		timeout, err = ParseDuration(rule.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout in rule for %s: %w", u.Host, err)
+		}
+	}
+
+	client, err := clientFor(rule.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey, ttl, useCache := cacheSettings(url, rule, opts.followRedirects)
+	if opts.trace != nil {
+		// traces show what the rule does to the page, not to the cached page
+		useCache = false
+	}
+
+	if opts.transport != nil {
+		client = &http.Client{Transport: opts.transport, CheckRedirect: client.CheckRedirect}
+		useCache = false
+	}
+	var stale *cache.Entry
+	if useCache {
+		if entry, ok := responseCache.Get(cacheKey); ok {
+			switch {
+			case entry.Fresh(time.Now()):
+				req := newUpstreamRequest(context.Background(), url, u, rule)
+				resp := cachedResponse(req, entry, "HIT")
+				observeCache("hit")
+				recordFetch(opts.log(), u, req, resp, rule, "", start)
+				body := newCountingBody(resp.Body, domain)
+				return &fetchResult{Body: body, Request: req, Response: resp, Rule: rule}, nil
+			case entry.Revalidatable():
+				stale = entry
+			}
+		}
+	}
+
+	req, resp, strategy, err := fetchUpstream(client, url, u, rule, timeout, opts, stale)
+	if err != nil {
+		upstreamRequests.WithLabelValues(domain, "error").Inc()
+		return nil, err
+	}
+
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		refreshed := *stale
+		refreshed.Expires = time.Now().Add(ttl)
+		if err := responseCache.Set(cacheKey, &refreshed); err != nil {
+			opts.log().Warn("failed to cache response", logging.Err(err))
+		}
+
+		resp := cachedResponse(req, &refreshed, "REVALIDATED")
+		observeCache("revalidated")
+		recordFetch(opts.log(), u, req, resp, rule, strategy, start)
+		body := newCountingBody(resp.Body, domain)
+		return &fetchResult{Body: body, Request: req, Response: resp, Rule: rule, Strategy: strategy}, nil
+	}
+
+	if useCache {
+		observeCache("miss")
+	}
+
+	if strategy != "" {
+		resp.Header.Set("X-Ladder-Strategy", strategy)
+	}
+
+	recordFetch(opts.log(), u, req, resp, rule, strategy, start)
+
+	if rule.Headers.CSP != "" {
+		resp.Header.Set("Content-Security-Policy", rule.Headers.CSP)
+	}
+
+	rule.ResponseHeaders.Apply(resp.Header)
+
+	if opts.trace != nil {
+		opts.trace.response(req, resp, strategy)
+	}
+
+	var body io.ReadCloser = resp.Body
+
+	name, process := selectProcessor(resp, rule)
+	traced := name == "html" && process != nil && opts.trace != nil
+	if traced {
+		process = opts.trace.rewriteHtml
+	}
+	if process != nil {
+		// the rewritten body has a different length than the upstream one
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+
+		pr, pw := io.Pipe()
+		go func() {
+			start := time.Now()
+			err := process(pw, resp.Body, resp.Request.URL, rule)
+			if opts.timings != nil {
+				opts.timings.add(&opts.timings.Rewrite, start)
+			}
+			observeRewrite(name, start)
+			if err == nil && traced {
+				// after the rewrite, so that the panel shows its timing
+				err = opts.trace.writePanel(pw)
+			}
+			pw.CloseWithError(err)
+		}()
+
+		body = readCloser{pr, func() error {
+			pr.Close()
+			return resp.Body.Close()
+		}}
+	}
+
+	if useCache && cacheable(resp, rule) {
+		now := time.Now()
+		body = newCachingBody(body, cacheKey, &cache.Entry{
+			URL:        cache.NormalizeURL(u.String() + urlQuery),
+			Source:     req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header.Clone(),
+			StoredAt:   now,
+			Expires:    now.Add(ttl),
+		})
+		resp.Header.Set("X-Ladder-Cache", "MISS")
+	}
+
+	body = newCountingBody(body, domain)
+
+	return &fetchResult{Body: body, Request: req, Response: resp, Rule: rule, Strategy: strategy}, nil
+}
+
+// recordFetch logs the response of the site to req, with the time since start, and counts it in the metrics.
+// u is the URL that was requested through ladder.
+func recordFetch(logger *slog.Logger, u *url.URL, req *http.Request, resp *http.Response, rule ruleset.Rule, strategy string, start time.Time) {
+	domain := metricsDomain(u.Hostname(), rule)
+	upstreamRequests.WithLabelValues(domain, statusClass(resp.StatusCode)).Inc()
+	if resp.Header.Get("X-Ladder-Cache") != "HIT" {
+		upstreamDuration.WithLabelValues(domain).Observe(time.Since(start).Seconds())
+	}
+	if label := rule.Label(); label != "" {
+		ruleMatches.WithLabelValues(label).Inc()
 	}
-	req, _ := http.NewRequest("GET", url, nil)
+
+	attrs := []any{
+		logging.Private("url", req.URL.String()),
+		logging.Private("host", req.URL.Host),
+		logging.Private("rule", rule.Label()),
+		"status", resp.StatusCode,
+		"duration", time.Since(start),
+	}
+	if strategy != "" {
+		attrs = append(attrs, "strategy", strategy)
+	}
+	if cached := resp.Header.Get("X-Ladder-Cache"); cached != "" {
+		attrs = append(attrs, "cache", cached)
+	}
+	logger.Info("fetched", attrs...)
+}
+
+// newUpstreamRequest creates the request for target with the rule's request headers set.
+// u is the URL that was requested through ladder.
+func newUpstreamRequest(ctx context.Context, target string, u *url.URL, rule ruleset.Rule) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, "GET", target, nil)
 
 	if rule.Headers.UserAgent != "" {
 		req.Header.Set("User-Agent", rule.Headers.UserAgent)
@@ -133,51 +386,63 @@ func FetchSite(urlpath string, queries map[string]string) (string, *http.Request
 		req.Header.Set("Cookie", rule.Headers.Cookie)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", nil, nil, err
+	rule.RequestHeaders.Apply(req.Header)
+
+	// the transport only decompresses bodies if it asks for compression itself, and bodies
+	// are sent to the client without their Content-Encoding
+	req.Header.Del("Accept-Encoding")
+
+	return req
+}
+
+// maxRewriteSize is the largest page that regexRules, dom and injections are applied to. They need
+// the whole document in memory, so larger pages only get their URLs rewritten.
+const maxRewriteSize = 10 << 20
+
+// rewriteHtml streams the HTML from r to w with all URLs rewritten to their proxied form.
+// Rules that need the whole document, regexRules, dom and injections, make it buffer pages of up
+// to maxRewriteSize before applying them. Otherwise memory use does not depend on the size of the page.
+func rewriteHtml(w io.Writer, r io.Reader, u *url.URL, rule ruleset.Rule) error {
+	return rewriteHtmlTrace(w, r, u, rule, nil)
+}
+
+// rewriteHtmlTrace is rewriteHtml, and records the effects of the rule in trace if it is not nil.
+func rewriteHtmlTrace(w io.Writer, r io.Reader, u *url.URL, rule ruleset.Rule, trace *fetchTrace) error {
+	if len(rule.RegexRules) == 0 && len(rule.DOM) == 0 && len(rule.Injections) == 0 {
+		return rewriteURLs(w, r, u)
 	}
-	defer resp.Body.Close()
 
-	bodyB, err := io.ReadAll(resp.Body)
+	head, err := io.ReadAll(io.LimitReader(r, maxRewriteSize+1))
 	if err != nil {
-		return "", nil, nil, err
+		return err
 	}
-
-	if rule.Headers.CSP != "" {
-		// log.Println(rule.Headers.CSP)
-		resp.Header.Set("Content-Security-Policy", rule.Headers.CSP)
+	if len(head) > maxRewriteSize {
+		slog.Warn("page too large to apply the rule, only rewriting its URLs", logging.Private("url", u.String()), logging.Private("rule", rule.Label()))
+		return rewriteURLs(w, io.MultiReader(bytes.NewReader(head), r), u)
 	}
 
-	// log.Print("rule", rule) TODO: Add a debug mode to print the rule
-	body := rewriteHtml(bodyB, u, rule)
-	return body, req, resp, nil
-}
-
-func rewriteHtml(bodyB []byte, u *url.URL, rule ruleset.Rule) string {
-	// Rewrite the HTML
-	body := string(bodyB)
+	var buf bytes.Buffer
+	if err := rewriteURLs(&buf, bytes.NewReader(head), u); err != nil {
+		return err
+	}
 
-	// images
-	imagePattern := `<img\s+([^>]*\s+)?src="(/)([^"]*)"`
-	re := regexp.MustCompile(imagePattern)
-	body = re.ReplaceAllString(body, fmt.Sprintf(`<img $1 src="%s$3"`, "/https://"+u.Host+"/"))
+	body, err := applyRules(buf.String(), rule, u, trace)
+	if err != nil {
+		return err
+	}
 
-	// scripts
-	scriptPattern := `<script\s+([^>]*\s+)?src="(/)([^"]*)"`
-	reScript := regexp.MustCompile(scriptPattern)
-	body = reScript.ReplaceAllString(body, fmt.Sprintf(`<script $1 script="%s$3"`, "/https://"+u.Host+"/"))
+	_, err = io.WriteString(w, body)
+	return err
+}
 
-	// body = strings.ReplaceAll(body, "srcset=\"/", "srcset=\"/https://"+u.Host+"/") // TODO: Needs a regex to rewrite the URL's
-	body = strings.ReplaceAll(body, "href=\"/", "href=\"/https://"+u.Host+"/")
-	body = strings.ReplaceAll(body, "url('/", "url('/https://"+u.Host+"/")
-	body = strings.ReplaceAll(body, "url(/", "url(/https://"+u.Host+"/")
-	body = strings.ReplaceAll(body, "href=\"https://"+u.Host, "href=\"/https://"+u.Host+"/")
+// readCloser is an io.ReadCloser with a custom close function.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
 
-	if os.Getenv("RULESET") != "" {
-		body = applyRules(body, rule)
-	}
-	return body
+func (rc readCloser) Close() error {
+	return rc.close()
 }
 
 func getenv(key, fallback string) string {
@@ -188,42 +453,79 @@ func getenv(key, fallback string) string {
 	return value
 }
 
-func fetchRule(domain string, path string) ruleset.Rule {
-	if len(rulesSet) == 0 {
-		return ruleset.Rule{}
+// getenvDuration returns the duration in the environment variable key, or fallback if it is unset or invalid.
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
 	}
-	rule := ruleset.Rule{}
-	for _, rule := range rulesSet {
-		domains := rule.Domains
-		if rule.Domain != "" {
-			domains = append(domains, rule.Domain)
-		}
-		for _, ruleDomain := range domains {
-			if ruleDomain == domain || strings.HasSuffix(domain, ruleDomain) {
-				if len(rule.Paths) > 0 && !StringInSlice(path, rule.Paths) {
-					continue
-				}
-				// return first match
-				return rule
-			}
-		}
+
+	d, err := ParseDuration(value)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, logging.Err(err))
+		return fallback
 	}
-	return rule
+	return d
 }
 
-func applyRules(body string, rule ruleset.Rule) string {
-	if len(rulesSet) == 0 {
-		return body
+// getenvInt returns the integer in the environment variable key, or fallback if it is unset or invalid.
+func getenvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, logging.Err(err))
+		return fallback
 	}
+	return n
+}
+
+// useRuleset replaces the rules applied to fetched sites.
+func useRuleset(rs ruleset.RuleSet) {
+	rules.Store(ruleset.NewMatcher(rs))
+}
 
+// applyRules applies the regexRules, dom operations and injections of rule to body, the page at u
+// with its URLs already rewritten. If trace is not nil, the number of matches of each of them is recorded in it.
+func applyRules(body string, rule ruleset.Rule, u *url.URL, trace *fetchTrace) (string, error) {
 	for _, regexRule := range rule.RegexRules {
-		re := regexp.MustCompile(regexRule.Match)
+		re, err := regexRule.Regexp()
+		if err != nil {
+			slog.Warn("skipping invalid regexRule", "match", regexRule.Match, logging.Private("rule", rule.Label()), logging.Err(err))
+			if trace != nil {
+				trace.regexRule(regexRule, 0, err)
+			}
+			continue
+		}
+		if trace != nil {
+			trace.regexRule(regexRule, len(re.FindAllStringIndex(body, -1)), nil)
+		}
 		body = re.ReplaceAllString(body, regexRule.Replace)
 	}
+	if len(rule.DOM) == 0 && len(rule.Injections) == 0 {
+		return body, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	base := normalizeBase(u)
+	for _, op := range rule.DOM {
+		// the elements are selected before the operation, which may change what the selector matches
+		sel := doc.Find(op.Selector)
+		if trace != nil {
+			trace.dom(op.Selector, sel.Length())
+		}
+		op.Apply(doc)
+		proxyWrittenAttrs(sel, op.WrittenAttrs(), base)
+	}
 	for _, injection := range rule.Injections {
-		doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
-		if err != nil {
-			log.Fatal(err)
+		if trace != nil {
+			trace.injection(injection.Position, doc.Find(injection.Position).Length())
 		}
 		if injection.Replace != "" {
 			doc.Find(injection.Position).ReplaceWithHtml(injection.Replace)
@@ -234,13 +536,32 @@ func applyRules(body string, rule ruleset.Rule) string {
 		if injection.Prepend != "" {
 			doc.Find(injection.Position).PrependHtml(injection.Prepend)
 		}
-		body, err = doc.Html()
-		if err != nil {
-			log.Fatal(err)
-		}
 	}
 
-	return body
+	return doc.Html()
+}
+
+// proxyWrittenAttrs rewrites the URLs in attrs of the elements in sel, which a dom operation
+// renamed or set after the URLs of the page were rewritten, e.g. src renamed from data-src.
+// Values that were proxied already, e.g. href renamed to src, are kept as they are.
+func proxyWrittenAttrs(sel *goquery.Selection, attrs []string, base *url.URL) {
+	if len(attrs) == 0 {
+		return
+	}
+
+	sel.Each(func(_ int, s *goquery.Selection) {
+		tag := goquery.NodeName(s)
+		for _, attr := range attrs {
+			attr = strings.ToLower(attr)
+			value, ok := s.Attr(attr)
+			if !ok || isProxied(value) {
+				continue
+			}
+			if proxied, ok := rewriteAttr(tag, attr, value, base, false); ok {
+				s.SetAttr(attr, proxied)
+			}
+		}
+	})
 }
 
 func StringInSlice(s string, list []string) bool {
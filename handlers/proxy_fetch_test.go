@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchSiteStreamsHtml(t *testing.T) {
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<html><body><img src="/first.jpg">`+strings.Repeat(" ", 8192))
+		w.(http.Flusher).Flush()
+
+		// hold back the rest of the page until the first part has been read
+		<-release
+		io.WriteString(w, `<img src="/second.jpg"></body></html>`)
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	body, _, _, err := FetchSite(upstream.URL+"/page", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer body.Close()
+
+	first := make([]byte, 64)
+	n, err := io.ReadAtLeast(body, first, 40)
+	assert.NoError(t, err)
+	assert.Contains(t, string(first[:n]), `src="/`+upstream.URL+`/first.jpg"`)
+}
+
+func TestFetchSitePassesThroughBinary(t *testing.T) {
+	data := bytes.Repeat([]byte{0xff, 0xd8, 's', 'r', 'c', '=', '"', '/'}, 4096)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer upstream.Close()
+
+	body, _, resp, err := FetchSite(upstream.URL+"/image.jpg", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer body.Close()
+
+	actual, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, data, actual)
+	assert.Equal(t, int64(len(data)), resp.ContentLength)
+}
+
+func TestFetchSiteReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first part")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	defer ConfigureTransport(transportConfig)
+	cfg := transportConfig
+	cfg.ReadTimeout = 50 * time.Millisecond
+	ConfigureTransport(cfg)
+
+	body, _, _, err := FetchSite(upstream.URL+"/slow", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer body.Close()
+
+	start := time.Now()
+	_, err = io.ReadAll(body)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRewriteHtmlMaxSize(t *testing.T) {
+	u, _ := url.Parse("https://example.com/page")
+	rule := ruleset.Rule{
+		Injections: []ruleset.Injection{{Position: "body", Append: "<p>injected</p>"}},
+	}
+
+	var out bytes.Buffer
+	err := rewriteHtml(&out, strings.NewReader(`<html><body><img src="/a.jpg"></body></html>`), u, rule)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "injected")
+
+	// larger pages are streamed with their URLs rewritten, without the rule
+	page := `<html><body><img src="/a.jpg">` + strings.Repeat("<p>text</p>", maxRewriteSize/11+1) + `<img src="/b.jpg"></body></html>`
+	out.Reset()
+	err = rewriteHtml(&out, strings.NewReader(page), u, rule)
+	assert.NoError(t, err)
+	assert.NotContains(t, out.String(), "injected")
+	assert.Contains(t, out.String(), `src="/https://example.com/a.jpg"`)
+	assert.Contains(t, out.String(), `src="/https://example.com/b.jpg"`)
+	assert.Equal(t, len(page)+2*len("/https://example.com"), out.Len())
+}
+
+func TestRewriteHtmlDOMAttrs(t *testing.T) {
+	u, _ := url.Parse("https://example.com/articles/page")
+	rule := ruleset.Rule{
+		DOM: []ruleset.DOMOperation{
+			{Selector: "img[data-src]", RenameAttr: map[string]string{"data-src": "src", "data-srcset": "srcset"}},
+			{Selector: "a.more", SetAttr: map[string]string{"href": "next", "title": "https://example.com/"}},
+			{Selector: "a.swap", RenameAttr: map[string]string{"href": "src"}},
+		},
+	}
+
+	page := `<img data-src="https://cdn.example.com/x.jpg" data-srcset="x-2.jpg 2x">` +
+		`<a class="more" href="/old">more</a><img src="/kept.jpg"><a class="swap" href="/pic.jpg">pic</a>`
+
+	var out bytes.Buffer
+	err := rewriteHtml(&out, strings.NewReader(page), u, rule)
+	assert.NoError(t, err)
+
+	// URLs the dom operations write are proxied like the ones of the page
+	assert.Contains(t, out.String(), `src="/https://cdn.example.com/x.jpg"`)
+	assert.Contains(t, out.String(), `srcset="/https://example.com/articles/x-2.jpg 2x"`)
+	assert.Contains(t, out.String(), `href="/https://example.com/articles/next"`)
+	assert.Contains(t, out.String(), `title="https://example.com/"`)
+	assert.Contains(t, out.String(), `src="/https://example.com/kept.jpg"`)
+
+	// URLs that were proxied before they were renamed are not proxied twice
+	assert.Contains(t, out.String(), `<a class="swap" src="/https://example.com/pic.jpg">`)
+}
@@ -4,12 +4,14 @@ package handlers
 
 import (
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/url"
 	"os"
 	"strings"
 
-	"github.com/andesco/ladder/pkg/ruleset"
+	"github.com/andesco/ladder/pkg/logging"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -53,9 +55,7 @@ func extractUrl(c *fiber.Ctx) (string, error) {
 			RawQuery: urlQuery.RawQuery,
 		}
 
-		if os.Getenv("LOG_URLS") == "true" {
-			log.Printf("modified relative URL: '%s' -> '%s'", reqUrl, fullUrl.String())
-		}
+		requestLogger(c).Debug("modified relative URL", logging.Private("url", reqUrl), logging.Private("modified", fullUrl.String()))
 		return fullUrl.String(), nil
 
 	}
@@ -65,34 +65,58 @@ func extractUrl(c *fiber.Ctx) (string, error) {
 	return urlQuery.String(), nil
 }
 
+// ProxySite serves sites through ladder. The ruleset in rulesetPath, or else in the RULESET
+// environment variable, is reloaded when it changes.
 func ProxySite(rulesetPath string) fiber.Handler {
 	if rulesetPath != "" {
-		rs, err := ruleset.NewRuleset(rulesetPath)
-		if err != nil {
+		if err := WatchRuleset(rulesetPath); err != nil {
 			panic(err)
 		}
-		rulesSet = rs
+	} else if rulesetPath, ok := os.LookupEnv("RULESET"); ok {
+		if err := WatchRuleset(rulesetPath); err != nil {
+			slog.Error("failed to load ruleset", logging.Err(err))
+		}
+	} else {
+		slog.Warn("no ruleset specified. Set the `RULESET` environment variable to load one for a better success rate.")
 	}
 
 	return func(c *fiber.Ctx) error {
 		// Get the url from the URL
 		url, err := extractUrl(c)
 		if err != nil {
-			log.Println("ERROR In URL extraction:", err)
+			requestLogger(c).Error("failed to extract URL", logging.Err(err))
 		}
 
+		// redirects are passed on to the client, so that the browser's URL matches the page
 		queries := c.Queries()
-		body, _, resp, err := FetchSite(url, queries)
+		opts := fetchOptions{followRedirects: false, logger: requestLogger(c)}
+		if mode := debugMode(queries, c.Get("X-Ladder-Debug")); mode != "" {
+			opts.trace = newFetchTrace(mode)
+		}
+
+		res, err := fetchSite(url, queries, opts)
 		if err != nil {
-			log.Println("ERROR:", err)
-			c.SendStatus(fiber.StatusInternalServerError)
+			requestLogger(c).Error("failed to fetch site", logging.Err(err))
+			c.SendStatus(errorStatus(err))
 			return c.SendString(err.Error())
 		}
 
+		if opts.trace != nil && opts.trace.mode == debugJSON {
+			defer res.Body.Close()
+			if _, err := io.Copy(io.Discard, res.Body); err != nil {
+				requestLogger(c).Error("failed to rewrite page", logging.Err(err))
+			}
+			return c.JSON(opts.trace.finish())
+		}
+
 		c.Cookie(&fiber.Cookie{})
-		c.Set("Content-Type", resp.Header.Get("Content-Type"))
-		c.Set("Content-Security-Policy", resp.Header.Get("Content-Security-Policy"))
+		for key, values := range forwardedHeaders(res.Response, res.Rule.ResponseHeaders) {
+			for _, value := range values {
+				c.Response().Header.Add(key, value)
+			}
+		}
 
-		return c.SendString(body)
+		c.Status(res.Response.StatusCode)
+		return c.SendStream(res.Body, int(res.Response.ContentLength))
 	}
 }
\ No newline at end of file
@@ -1,7 +1,9 @@
 package handlers
 
 import (
-	"log"
+	"errors"
+
+	"github.com/andesco/ladder/pkg/logging"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -11,11 +13,30 @@ func Raw(c *fiber.Ctx) error {
 	urlQuery := c.Params("*")
 
 	queries := c.Queries()
-	body, _, _, err := FetchSite(urlQuery, queries)
+	format := outputFormat(queries)
+	res, err := fetchSite(urlQuery, queries, fetchOptions{followRedirects: true, logger: requestLogger(c)})
+	if err != nil {
+		requestLogger(c).Error("failed to fetch site", logging.Err(err))
+		c.SendStatus(errorStatus(err))
+		return c.SendString(err.Error())
+	}
+
+	if format == "html" {
+		return c.SendStream(res.Body, int(res.Response.ContentLength))
+	}
+	defer res.Body.Close()
+
+	out, err := renderArticle(res.Body, res.Response, format)
+	if errors.Is(err, errNotHTML) {
+		c.SendStatus(fiber.StatusUnsupportedMediaType)
+		return c.SendString(err.Error())
+	}
 	if err != nil {
-		log.Println("ERROR:", err)
+		requestLogger(c).Error("failed to render article", logging.Err(err))
 		c.SendStatus(500)
 		return c.SendString(err.Error())
 	}
-	return c.SendString(body)
+
+	c.Set("Content-Type", formats[format])
+	return c.SendString(out)
 }
@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	xhtml "golang.org/x/net/html"
+)
+
+// article is the main content of a page, as extracted by extractArticle.
+type article struct {
+	Title    string
+	Byline   string
+	SiteName string
+	// Published is the publication date, as found in the page
+	Published string
+	// Image is the proxied URL of the hero image
+	Image string
+	// Content is the cleaned HTML of the article body, with all URLs proxied
+	Content string
+	// URL is the page the article was extracted from
+	URL string
+}
+
+// Date returns the publication date in a readable format, or as found in the page if it cannot be parsed.
+func (a article) Date() string {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, a.Published); err == nil {
+			return t.Format("January 2, 2006")
+		}
+	}
+	return a.Published
+}
+
+var (
+	// unlikelyCandidates are classes and ids of elements that are not part of the article
+	unlikelyCandidates = regexp.MustCompile(`(?i)-ad-|ad-break|adbox|advert|banner|breadcrumb|combx|comment|community|cookie|cover-wrap|disqus|extra|footer|gdpr|header|legends|menu|modal|newsletter|overlay|pager|pagination|paywall|popup|promo|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|subscribe|supplemental|tags|tool|widget`)
+	// maybeCandidates are classes and ids that keep an element even if it also looks unlikely
+	maybeCandidates = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow|story|text`)
+	positiveClass   = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|pagination|post|text|blog|story`)
+	negativeClass   = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+
+	// articleTypes are the schema.org types of JSON-LD objects that describe an article
+	articleTypes = regexp.MustCompile(`^(\w*Article|\w*BlogPosting|Report)$`)
+)
+
+// junkSelector matches elements that are never part of the article. Headers are only removed outside of articles.
+const junkSelector = `script, style, noscript, iframe, frame, object, embed, form, input, button, select, textarea, svg, canvas, nav, aside, footer, dialog, [role=dialog], [role=navigation], [role=banner], [role=complementary], [aria-hidden=true], [hidden]`
+
+// keptAttrs are the attributes that are left on elements of the article content.
+var keptAttrs = map[string]bool{
+	"href": true, "src": true, "srcset": true, "alt": true, "title": true,
+	"colspan": true, "rowspan": true, "datetime": true, "cite": true,
+}
+
+// extractArticle finds the main content of the page in doc, with readability-style scoring of its
+// paragraphs. Metadata comes from JSON-LD and from the og: and article: meta tags, falling back to
+// the page itself. JSON-LD articleBody replaces the content if the page holds less text than it.
+// doc is modified. pageURL is the URL of the page, to resolve references that are not proxied yet.
+func extractArticle(doc *goquery.Document, pageURL *url.URL) article {
+	base := normalizeBase(pageURL)
+	ld := jsonLDArticle(doc)
+
+	a := article{
+		Title:     firstNonEmpty(ld.Headline, ld.Name, metaContent(doc, "og:title", "twitter:title"), doc.Find("title").First().Text(), doc.Find("h1").First().Text()),
+		Byline:    firstNonEmpty(ld.author(), metaContent(doc, "author", "article:author", "byl"), doc.Find(`[rel=author], [itemprop=author], .byline, .author`).First().Text()),
+		SiteName:  firstNonEmpty(metaContent(doc, "og:site_name", "application-name"), ld.publisher()),
+		Published: firstNonEmpty(ld.DatePublished, metaContent(doc, "article:published_time", "date", "pubdate"), doc.Find("time[datetime]").First().AttrOr("datetime", "")),
+		URL:       pageURL.String(),
+	}
+	a.Title = strings.TrimSpace(a.Title)
+	a.Byline = strings.Join(strings.Fields(a.Byline), " ")
+
+	if image := firstNonEmpty(ld.image(), metaContent(doc, "og:image", "twitter:image")); image != "" {
+		a.Image = readerURL(base, image)
+	}
+
+	doc.Find(junkSelector).Remove()
+	doc.Find("header").Not("article header").Remove()
+	removeUnlikelyCandidates(doc.Selection)
+
+	content := topCandidate(doc)
+	if content == nil || (len(ld.ArticleBody) > 2*len(strings.TrimSpace(content.Text()))) {
+		content = articleBodySelection(ld.ArticleBody)
+	}
+	if content == nil {
+		return a
+	}
+
+	cleanContent(content, base)
+
+	// the hero image is shown above the content, so drop it from the content
+	if a.Image != "" {
+		content.Find("img").FilterFunction(func(_ int, img *goquery.Selection) bool {
+			return img.AttrOr("src", "") == a.Image
+		}).Remove()
+	}
+
+	// a heading with the title is shown above the content already
+	content.Find("h1").FilterFunction(func(_ int, h *goquery.Selection) bool {
+		return strings.TrimSpace(h.Text()) == a.Title
+	}).Remove()
+
+	a.Content, _ = content.Html()
+	return a
+}
+
+// removeUnlikelyCandidates removes elements whose class or id suggest they are not part of the article.
+func removeUnlikelyCandidates(sel *goquery.Selection) {
+	sel.Find("div, section, span, ul, table").Each(func(_ int, s *goquery.Selection) {
+		if s.Is("body, article, main") || s.Find("article, main").Length() > 0 {
+			return
+		}
+		names := s.AttrOr("class", "") + " " + s.AttrOr("id", "")
+		if unlikelyCandidates.MatchString(names) && !maybeCandidates.MatchString(names) {
+			s.Remove()
+		}
+	})
+}
+
+// topCandidate scores the parents of all paragraphs by the amount of text they hold, and returns
+// the best one together with the siblings that seem to belong to it. It returns nil if the page has no text.
+func topCandidate(doc *goquery.Document) *goquery.Selection {
+	scores := map[*xhtml.Node]float64{}
+	var candidates []*goquery.Selection
+
+	doc.Find("p, pre, td, blockquote").Each(func(_ int, p *goquery.Selection) {
+		text := strings.TrimSpace(p.Text())
+		if len(text) < 25 {
+			return
+		}
+
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text)/100), 3)
+
+		for level, ancestor := range []*goquery.Selection{p.Parent(), p.Parent().Parent()} {
+			if ancestor.Length() == 0 || ancestor.Is("html") {
+				continue
+			}
+			node := ancestor.Get(0)
+			if _, ok := scores[node]; !ok {
+				scores[node] = initialScore(ancestor)
+				candidates = append(candidates, ancestor)
+			}
+			if level == 0 {
+				scores[node] += score
+			} else {
+				scores[node] += score / 2
+			}
+		}
+	})
+
+	var top *goquery.Selection
+	topScore := 0.0
+	for _, c := range candidates {
+		score := scores[c.Get(0)] * (1 - linkDensity(c))
+		scores[c.Get(0)] = score
+		if top == nil || score > topScore {
+			top, topScore = c, score
+		}
+	}
+	if top == nil {
+		return nil
+	}
+
+	// siblings with a good score, or paragraphs with a lot of text, are also part of the article
+	threshold := math.Max(10, topScore*0.2)
+	content := top
+	top.Siblings().Each(func(_ int, s *goquery.Selection) {
+		if score, ok := scores[s.Get(0)]; ok && score >= threshold {
+			content = content.AddSelection(s)
+			return
+		}
+		if s.Is("p") {
+			text := strings.TrimSpace(s.Text())
+			if len(text) > 80 && linkDensity(s) < 0.25 {
+				content = content.AddSelection(s)
+			}
+		}
+	})
+
+	if content.Length() == 1 {
+		return top
+	}
+
+	// keep the document order of the siblings
+	wrapper := top.Parent().Clone().Empty()
+	top.Parent().Children().Each(func(_ int, s *goquery.Selection) {
+		if content.IsSelection(s) {
+			wrapper.AppendSelection(s.Clone())
+		}
+	})
+	return wrapper
+}
+
+// initialScore is the score of an element before the text of its paragraphs is counted.
+func initialScore(s *goquery.Selection) float64 {
+	score := 0.0
+	switch goquery.NodeName(s) {
+	case "div", "article", "main", "section":
+		score += 5
+	case "pre", "td", "blockquote":
+		score += 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+
+	for _, name := range []string{s.AttrOr("class", ""), s.AttrOr("id", "")} {
+		if name == "" {
+			continue
+		}
+		if negativeClass.MatchString(name) {
+			score -= 25
+		}
+		if positiveClass.MatchString(name) {
+			score += 25
+		}
+	}
+	return score
+}
+
+// linkDensity is the share of the text of s that is inside links.
+func linkDensity(s *goquery.Selection) float64 {
+	text := len(strings.TrimSpace(s.Text()))
+	if text == 0 {
+		return 0
+	}
+
+	links := 0
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		links += len(strings.TrimSpace(a.Text()))
+	})
+	return float64(links) / float64(text)
+}
+
+// cleanContent removes presentational attributes and empty elements from the article content,
+// and makes sure that lazy loaded images and all links go through the proxy.
+func cleanContent(content *goquery.Selection, base *url.URL) {
+	content.Find("img").Each(func(_ int, img *goquery.Selection) {
+		src := img.AttrOr("src", "")
+		lazy := firstNonEmpty(img.AttrOr("data-src", ""), img.AttrOr("data-lazy-src", ""), img.AttrOr("data-original", ""))
+		if lazy != "" && (src == "" || strings.HasPrefix(src, "data:")) {
+			img.SetAttr("src", lazy)
+		}
+		if srcset := img.AttrOr("data-srcset", ""); srcset != "" {
+			img.SetAttr("srcset", rewriteSrcset(srcset, base))
+		}
+	})
+
+	content.Find("*").AddSelection(content).Each(func(_ int, s *goquery.Selection) {
+		node := s.Get(0)
+		attrs := node.Attr[:0]
+		for _, attr := range node.Attr {
+			if !keptAttrs[attr.Key] {
+				continue
+			}
+			if attr.Key == "href" || attr.Key == "src" {
+				if strings.HasPrefix(attr.Val, "#") {
+					attrs = append(attrs, attr)
+					continue
+				}
+				attr.Val = readerURL(base, attr.Val)
+				if attr.Val == "" {
+					continue
+				}
+			}
+			attrs = append(attrs, attr)
+		}
+		node.Attr = attrs
+	})
+
+	content.Find("div, span, section, p").Each(func(_ int, s *goquery.Selection) {
+		if strings.TrimSpace(s.Text()) == "" && s.Find("img, picture, video, table, hr, br").Length() == 0 {
+			s.Remove()
+		}
+	})
+}
+
+// readerURL returns the proxied form of ref, which is returned as is if it is proxied already.
+// It returns an empty string for URLs that cannot be proxied, such as javascript: URLs.
+func readerURL(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if isProxied(ref) {
+		return ref
+	}
+	proxied, ok := proxyURL(base, ref)
+	if !ok {
+		return ""
+	}
+	return proxied
+}
+
+// articleBodySelection turns the plain text of a JSON-LD articleBody into paragraphs.
+func articleBodySelection(body string) *goquery.Selection {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("<div>")
+	for _, paragraph := range strings.Split(body, "\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			b.WriteString("<p>" + xhtml.EscapeString(paragraph) + "</p>")
+		}
+	}
+	b.WriteString("</div>")
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(b.String()))
+	if err != nil {
+		return nil
+	}
+	return doc.Find("body > div")
+}
+
+// metaContent returns the content of the first meta tag with one of names as its property or name.
+func metaContent(doc *goquery.Document, names ...string) string {
+	for _, name := range names {
+		sel := doc.Find(`meta[property="` + name + `"], meta[name="` + name + `"]`).First()
+		if content := strings.TrimSpace(sel.AttrOr("content", "")); content != "" {
+			return content
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ldArticle are the fields of a schema.org Article in JSON-LD that the reader uses.
+type ldArticle struct {
+	Type          any         `json:"@type"`
+	Headline      string      `json:"headline"`
+	Name          string      `json:"name"`
+	ArticleBody   string      `json:"articleBody"`
+	DatePublished string      `json:"datePublished"`
+	Author        any         `json:"author"`
+	Publisher     any         `json:"publisher"`
+	Image         any         `json:"image"`
+	Graph         []ldArticle `json:"@graph"`
+}
+
+// jsonLDArticle returns the first article in the JSON-LD scripts of doc, or an empty one.
+func jsonLDArticle(doc *goquery.Document) ldArticle {
+	var found *ldArticle
+
+	doc.Find(`script[type="application/ld+json"]`).EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		var objects []ldArticle
+		data := []byte(strings.TrimSpace(s.Text()))
+		if err := json.Unmarshal(data, &objects); err != nil {
+			var object ldArticle
+			if err := json.Unmarshal(data, &object); err != nil {
+				return true
+			}
+			objects = []ldArticle{object}
+		}
+
+		for len(objects) > 0 {
+			object := objects[0]
+			objects = append(objects[1:], object.Graph...)
+			if object.isArticle() {
+				found = &object
+				return false
+			}
+		}
+		return true
+	})
+
+	if found == nil {
+		return ldArticle{}
+	}
+	return *found
+}
+
+func (ld ldArticle) isArticle() bool {
+	for _, t := range ldStrings(ld.Type, "") {
+		if articleTypes.MatchString(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ld ldArticle) author() string {
+	return strings.Join(ldStrings(ld.Author, "name"), ", ")
+}
+
+func (ld ldArticle) publisher() string {
+	return firstNonEmpty(ldStrings(ld.Publisher, "name")...)
+}
+
+func (ld ldArticle) image() string {
+	return firstNonEmpty(ldStrings(ld.Image, "url")...)
+}
+
+// ldStrings returns the strings in a JSON-LD value, which is a string, an object with the string
+// in key, or a list of them.
+func ldStrings(v any, key string) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case map[string]any:
+		if s, ok := v[key].(string); ok {
+			return []string{s}
+		}
+	case []any:
+		var list []string
+		for _, item := range v {
+			list = append(list, ldStrings(item, key)...)
+		}
+		return list
+	}
+	return nil
+}
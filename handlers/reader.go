@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	_ "embed"
+	"html/template"
+	"strings"
+
+	"github.com/andesco/ladder/pkg/logging"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gofiber/fiber/v2"
+)
+
+//go:embed reader.html
+var readerHtml string
+
+var readerTemplate = template.Must(template.New("reader").Parse(readerHtml))
+
+// Reader fetches a page like ProxySite and shows only its main article, in a clean template.
+func Reader(c *fiber.Ctx) error {
+	// Get the url from the URL
+	urlQuery := c.Params("*")
+
+	queries := c.Queries()
+	res, err := fetchSite(urlQuery, queries, fetchOptions{followRedirects: true, logger: requestLogger(c)})
+	if err != nil {
+		requestLogger(c).Error("failed to fetch site", logging.Err(err))
+		c.SendStatus(errorStatus(err))
+		return c.SendString(err.Error())
+	}
+	defer res.Body.Close()
+
+	if processorFor(res.Response.Header.Get("Content-Type")) != "html" {
+		c.SendStatus(fiber.StatusUnsupportedMediaType)
+		return c.SendString("reader mode is only available for HTML pages")
+	}
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		requestLogger(c).Error("failed to parse page", logging.Err(err))
+		c.SendStatus(500)
+		return c.SendString(err.Error())
+	}
+
+	a := extractArticle(doc, res.Response.Request.URL)
+
+	var b strings.Builder
+	err = readerTemplate.Execute(&b, struct {
+		article
+		Content template.HTML
+	}{a, template.HTML(a.Content)})
+	if err != nil {
+		requestLogger(c).Error("failed to render reader template", logging.Err(err))
+		c.SendStatus(500)
+		return c.SendString(err.Error())
+	}
+
+	c.Status(res.Response.StatusCode)
+	c.Set("Content-Type", "text/html; charset=utf-8")
+	return c.SendString(b.String())
+}
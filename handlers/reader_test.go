@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const readerPage = `<!DOCTYPE html>
+<html><head>
+<title>Example | The Daily Example</title>
+<meta property="og:site_name" content="The Daily Example">
+<meta property="og:image" content="/images/hero.jpg">
+<meta property="article:published_time" content="2023-11-01T09:30:00Z">
+<script type="application/ld+json">{"@context":"https://schema.org","@graph":[{"@type":"WebSite","name":"The Daily Example"},
+{"@type":"NewsArticle","headline":"Rivers are rising","author":[{"@type":"Person","name":"Jane Doe"},{"@type":"Person","name":"John Roe"}]}]}</script>
+<script>trackReader()</script>
+</head><body>
+<nav><a href="/">Home</a><a href="/world">World</a></nav>
+<div class="newsletter-signup"><p>Sign up for our newsletter to get the news, every single morning.</p></div>
+<div id="story" class="article-body">
+<h1>Rivers are rising</h1>
+<p class="lead" style="font-weight:bold">The rivers of the region are rising, and the towns along them prepare for floods.</p>
+<p>Authorities said on Tuesday that water levels were higher than in any year since records began, in 1901.</p>
+<img data-src="/images/river.jpg" src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" alt="The river">
+<p>Residents have been asked to move valuables upstairs, and to <a href="/advice" onclick="track()">follow the advice</a> of the authorities.</p>
+</div>
+<aside class="related"><p>Related: another story, with links and, more commas, to make it look relevant.</p></aside>
+<footer><p>Copyright The Daily Example, all rights reserved, since forever.</p></footer>
+</body></html>`
+
+func TestExtractArticle(t *testing.T) {
+	u, _ := url.Parse("https://news.example.com/2023/rivers")
+
+	var rewritten strings.Builder
+	assert.NoError(t, rewriteURLs(&rewritten, strings.NewReader(readerPage), u))
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(rewritten.String()))
+	assert.NoError(t, err)
+
+	a := extractArticle(doc, u)
+	assert.Equal(t, "Rivers are rising", a.Title)
+	assert.Equal(t, "Jane Doe, John Roe", a.Byline)
+	assert.Equal(t, "The Daily Example", a.SiteName)
+	assert.Equal(t, "November 1, 2023", a.Date())
+	assert.Equal(t, "/https://news.example.com/images/hero.jpg", a.Image)
+
+	assert.Contains(t, a.Content, "water levels were higher")
+	assert.Contains(t, a.Content, `<img src="/https://news.example.com/images/river.jpg" alt="The river"/>`)
+	assert.Contains(t, a.Content, `<a href="/https://news.example.com/advice">follow the advice</a>`)
+	assert.Contains(t, a.Content, `<p>The rivers of the region`)
+	for _, unwanted := range []string{"<h1>", "newsletter", "Related", "Copyright", "World", "trackReader", "onclick"} {
+		assert.NotContains(t, a.Content, unwanted)
+	}
+}
+
+func TestExtractArticleBodyFromJSONLD(t *testing.T) {
+	u, _ := url.Parse("https://news.example.com/story")
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><head>
+<script type="application/ld+json">[{"@type":"Article","headline":"Locked","articleBody":"The first paragraph of the whole story.\nThe second paragraph, <with> markup characters.","image":{"@type":"ImageObject","url":"https://cdn.example.com/a.jpg"}}]</script>
+</head><body><div class="teaser"><p>Only the beginning of the story is visible.</p></div></body></html>`))
+	assert.NoError(t, err)
+
+	a := extractArticle(doc, u)
+	assert.Equal(t, "Locked", a.Title)
+	assert.Equal(t, "/https://cdn.example.com/a.jpg", a.Image)
+	assert.Equal(t, "<p>The first paragraph of the whole story.</p><p>The second paragraph, &lt;with&gt; markup characters.</p>", a.Content)
+}
+
+func TestReader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.pdf" {
+			w.Header().Set("Content-Type", "application/pdf")
+			io.WriteString(w, "%PDF-1.4")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, readerPage)
+	}))
+	defer upstream.Close()
+
+	app := fiber.New()
+	app.Get("/reader/*", Reader)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/reader/"+upstream.URL+"/2023/rivers", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "<title>Rivers are rising</title>")
+	assert.Contains(t, string(body), `<span class="byline">Jane Doe, John Roe</span>`)
+	assert.Contains(t, string(body), `<img class="hero" src="/`+upstream.URL+`/images/hero.jpg" alt="">`)
+	assert.Contains(t, string(body), "water levels were higher")
+	assert.Contains(t, string(body), `<a href="/`+upstream.URL+`/2023/rivers">`)
+	assert.NotContains(t, string(body), "trackReader")
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/reader/"+upstream.URL+"/file.pdf", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
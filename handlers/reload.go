@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
+	"github.com/andesco/ladder/pkg/ruleset"
+)
+
+var (
+	// rulesetReloadInterval is the interval local rulesets are checked for changes at, 0 disables it
+	rulesetReloadInterval = getenvDuration("RULESET_RELOAD_INTERVAL", 10*time.Second)
+	// rulesetRefreshInterval is the interval remote rulesets are requested again at, 0 disables it
+	rulesetRefreshInterval = getenvDuration("RULESET_REFRESH_INTERVAL", time.Hour)
+)
+
+// WatchRuleset loads the rulesets in rulesetPath and keeps them up to date in the background.
+// A reloaded ruleset replaces the current one at once, a ruleset that fails to load leaves the
+// previous rules in place. It returns an error if a local ruleset does not exist.
+func WatchRuleset(rulesetPath string) error {
+	w := ruleset.NewWatcher(rulesetPath, func(rs ruleset.RuleSet) {
+		useRuleset(rs)
+		rs.PrintStats()
+		rulesetReloads.WithLabelValues("success").Inc()
+	})
+	w.OnCheck = func(err error) {
+		rulesetState.checked(err, w.Pending())
+		if err != nil {
+			rulesetReloads.WithLabelValues("failure").Inc()
+		}
+	}
+
+	err := w.Check(true)
+	w.OnCheck(err)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		slog.Warn("failed to load ruleset", logging.Err(err))
+	}
+
+	go w.Run(context.Background(), rulesetReloadInterval, rulesetRefreshInterval)
+
+	return nil
+}
@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// urlAttrs lists the attributes that carry a single URL, keyed by attribute name.
+// A nil tag list means the attribute is a URL on every element.
+var urlAttrs = map[string][]string{
+	"href":       nil,
+	"src":        nil,
+	"action":     {"form"},
+	"formaction": {"button", "input"},
+	"poster":     {"video"},
+	"data":       {"object"},
+	"cite":       {"blockquote", "q", "del", "ins"},
+	"background": {"body", "table", "td", "th"},
+	"longdesc":   {"img", "frame", "iframe"},
+	"xlink:href": nil,
+}
+
+// srcsetAttrs lists the attributes that carry a comma separated list of image candidates.
+var srcsetAttrs = map[string]bool{
+	"srcset":      true,
+	"imagesrcset": true,
+}
+
+var (
+	cssURLRegex    = regexp.MustCompile(`url\(\s*(?:'([^']*)'|"([^"]*)"|([^'")\s]*))\s*\)`)
+	cssImportRegex = regexp.MustCompile(`@import\s*(?:'([^']*)'|"([^"]*)")`)
+	metaRefreshURL = regexp.MustCompile(`(?i)(url\s*=\s*['"]?)([^'";]+)`)
+)
+
+// rewriteURLs tokenizes the HTML read from r and writes it to w with every
+// URL-bearing attribute rewritten to its proxied form. Relative URLs are resolved
+// against base, or against the document's <base href> once it has been seen.
+// Tags that need no changes are written byte for byte.
+func rewriteURLs(w io.Writer, r io.Reader, base *url.URL) error {
+	base = normalizeBase(base)
+	z := xhtml.NewTokenizer(r)
+	inStyle := false
+
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+
+		raw := z.Raw()
+
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if tag == "style" && tt == xhtml.StartTagToken {
+				inStyle = true
+			}
+
+			newBase, out := rewriteTag(raw, tag, base)
+			base = newBase
+			if _, err := w.Write(out); err != nil {
+				return err
+			}
+			continue
+		case xhtml.EndTagToken:
+			inStyle = false
+		case xhtml.TextToken:
+			if inStyle {
+				if _, err := io.WriteString(w, rewriteCSS(string(raw), base)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// normalizeBase returns a copy of the page URL that is safe to resolve references against.
+func normalizeBase(u *url.URL) *url.URL {
+	base := *u
+	if base.Scheme == "" {
+		base.Scheme = "https"
+	}
+	if base.Path == "" {
+		base.Path = "/"
+	}
+	return &base
+}
+
+// proxyURL resolves ref against base and returns the proxied form of the result,
+// e.g. "/https://example.com/image.jpg". The second return value is false when
+// ref should be left untouched, such as fragments, data: and javascript: URLs.
+func proxyURL(base *url.URL, ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return "", false
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+
+	abs := base.ResolveReference(u)
+	if abs.Scheme != "http" && abs.Scheme != "https" {
+		return "", false
+	}
+
+	return "/" + abs.String(), true
+}
+
+// isProxied reports whether ref was proxied already, e.g. "/https://example.com/image.jpg".
+func isProxied(ref string) bool {
+	ref = strings.TrimSpace(ref)
+	return strings.HasPrefix(ref, "/http://") || strings.HasPrefix(ref, "/https://")
+}
+
+// rewriteTag rewrites the URL attributes of a single raw start tag. It returns the
+// base URL to use for the rest of the document, which changes on <base href>.
+func rewriteTag(raw []byte, tag string, base *url.URL) (*url.URL, []byte) {
+	attrs := scanAttrs(raw)
+	if len(attrs) == 0 {
+		return base, raw
+	}
+
+	newBase := base
+	if tag == "base" {
+		for _, a := range attrs {
+			if a.name == "href" {
+				if u, err := url.Parse(strings.TrimSpace(a.value)); err == nil {
+					newBase = base.ResolveReference(u)
+				}
+			}
+		}
+	}
+
+	isRefresh := false
+	if tag == "meta" {
+		for _, a := range attrs {
+			if a.name == "http-equiv" && strings.EqualFold(strings.TrimSpace(a.value), "refresh") {
+				isRefresh = true
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	last := 0
+	changed := false
+
+	for _, a := range attrs {
+		if !a.hasValue {
+			continue
+		}
+
+		value, ok := rewriteAttr(tag, a.name, a.value, base, isRefresh)
+		if !ok {
+			continue
+		}
+
+		out.Write(raw[last:a.start])
+		out.WriteString(quoteAttr(value, a.quote))
+		last = a.end
+		changed = true
+	}
+
+	if !changed {
+		return newBase, raw
+	}
+
+	out.Write(raw[last:])
+	return newBase, out.Bytes()
+}
+
+// rewriteAttr returns the rewritten value of a single attribute, or false if
+// the attribute does not hold a URL that should be proxied.
+func rewriteAttr(tag, name, value string, base *url.URL, isRefresh bool) (string, bool) {
+	switch {
+	case name == "style":
+		css := rewriteCSS(value, base)
+		return css, css != value
+	case srcsetAttrs[name]:
+		srcset := rewriteSrcset(value, base)
+		return srcset, srcset != value
+	case isRefresh && name == "content":
+		loc := metaRefreshURL.FindStringSubmatchIndex(value)
+		if loc == nil {
+			return "", false
+		}
+		proxied, ok := proxyURL(base, value[loc[4]:loc[5]])
+		if !ok {
+			return "", false
+		}
+		return value[:loc[4]] + proxied + value[loc[5]:], true
+	}
+
+	tags, isURL := urlAttrs[name]
+	if !isURL {
+		return "", false
+	}
+	if tags != nil && !stringIn(tag, tags) {
+		return "", false
+	}
+
+	return proxyURL(base, value)
+}
+
+// rewriteSrcset rewrites every image candidate URL of a srcset attribute,
+// keeping the width and density descriptors as they are.
+func rewriteSrcset(srcset string, base *url.URL) string {
+	var out strings.Builder
+	rest := srcset
+
+	for rest != "" {
+		// leading whitespace and separators
+		i := 0
+		for i < len(rest) && (isHTMLSpace(rest[i]) || rest[i] == ',') {
+			i++
+		}
+		out.WriteString(rest[:i])
+		rest = rest[i:]
+		if rest == "" {
+			break
+		}
+
+		// candidate url, up to the next whitespace
+		end := 0
+		for end < len(rest) && !isHTMLSpace(rest[end]) {
+			end++
+		}
+		candidate := rest[:end]
+		trailing := ""
+		if strings.HasSuffix(candidate, ",") {
+			candidate = strings.TrimRight(candidate, ",")
+			trailing = rest[len(candidate):end]
+		}
+
+		if proxied, ok := proxyURL(base, candidate); ok {
+			out.WriteString(proxied)
+		} else {
+			out.WriteString(candidate)
+		}
+		out.WriteString(trailing)
+		rest = rest[end:]
+
+		if trailing != "" {
+			continue
+		}
+
+		// descriptors, up to the next separator
+		end = strings.IndexByte(rest, ',')
+		if end == -1 {
+			end = len(rest)
+		}
+		out.WriteString(rest[:end])
+		rest = rest[end:]
+	}
+
+	return out.String()
+}
+
+// rewriteCSS rewrites url() references and @import rules in a stylesheet or a style attribute.
+func rewriteCSS(css string, base *url.URL) string {
+	replace := func(re *regexp.Regexp, s string) string {
+		return re.ReplaceAllStringFunc(s, func(match string) string {
+			sub := re.FindStringSubmatchIndex(match)
+			for i := 2; i < len(sub); i += 2 {
+				if sub[i] == -1 {
+					continue
+				}
+				proxied, ok := proxyURL(base, match[sub[i]:sub[i+1]])
+				if !ok {
+					return match
+				}
+				return match[:sub[i]] + proxied + match[sub[i+1]:]
+			}
+			return match
+		})
+	}
+
+	css = replace(cssURLRegex, css)
+	css = replace(cssImportRegex, css)
+	return css
+}
+
+// rawAttr is an attribute found in a raw tag, with the byte offsets of its
+// value (including quotes) so that it can be replaced in place.
+type rawAttr struct {
+	name     string
+	value    string
+	hasValue bool
+	quote    byte
+	start    int
+	end      int
+}
+
+// scanAttrs parses the attributes of a raw start tag as produced by the tokenizer.
+// Attribute names are lowercased and values are unescaped.
+func scanAttrs(raw []byte) []rawAttr {
+	var attrs []rawAttr
+
+	i := 1 // skip '<'
+	for i < len(raw) && !isHTMLSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' {
+		i++
+	}
+
+	for i < len(raw) {
+		for i < len(raw) && (isHTMLSpace(raw[i]) || raw[i] == '/') {
+			i++
+		}
+		if i >= len(raw) || raw[i] == '>' {
+			break
+		}
+
+		nameStart := i
+		i++ // an attribute name may start with '='
+		for i < len(raw) && !isHTMLSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' && raw[i] != '=' {
+			i++
+		}
+		attr := rawAttr{name: strings.ToLower(string(raw[nameStart:i]))}
+
+		j := i
+		for j < len(raw) && isHTMLSpace(raw[j]) {
+			j++
+		}
+		if j >= len(raw) || raw[j] != '=' {
+			attrs = append(attrs, attr)
+			continue
+		}
+		j++
+		for j < len(raw) && isHTMLSpace(raw[j]) {
+			j++
+		}
+
+		attr.hasValue = true
+		attr.start = j
+		if j < len(raw) && (raw[j] == '"' || raw[j] == '\'') {
+			attr.quote = raw[j]
+			end := bytes.IndexByte(raw[j+1:], attr.quote)
+			if end == -1 {
+				end = len(raw) - j - 1
+				attr.end = len(raw)
+			} else {
+				attr.end = j + 1 + end + 1
+			}
+			attr.value = string(raw[j+1 : j+1+end])
+		} else {
+			for j < len(raw) && !isHTMLSpace(raw[j]) && raw[j] != '>' {
+				j++
+			}
+			attr.end = j
+			attr.value = string(raw[attr.start:j])
+		}
+		attr.value = html.UnescapeString(attr.value)
+		i = attr.end
+
+		attrs = append(attrs, attr)
+	}
+
+	return attrs
+}
+
+// quoteAttr escapes an attribute value for the given quote character.
+// Unquoted values are written with double quotes.
+func quoteAttr(value string, quote byte) string {
+	value = strings.ReplaceAll(value, "&", "&amp;")
+	if quote == '\'' {
+		return "'" + strings.ReplaceAll(value, "'", "&#39;") + "'"
+	}
+	return `"` + strings.ReplaceAll(value, `"`, "&quot;") + `"`
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func stringIn(s string, list []string) bool {
+	for _, x := range list {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rewriteString(t *testing.T, page string, body string) string {
+	t.Helper()
+
+	u, err := url.Parse(page)
+	if err != nil {
+		t.Fatalf("failed to parse page url: %s", err)
+	}
+
+	var buf bytes.Buffer
+	err = rewriteURLs(&buf, strings.NewReader(body), u)
+	assert.NoError(t, err)
+
+	return buf.String()
+}
+
+func TestRewriteURLs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "double quoted relative src",
+			input:    `<img src="/image.jpg">`,
+			expected: `<img src="/https://example.com/image.jpg">`,
+		},
+		{
+			name:     "single quoted attribute",
+			input:    `<img alt='x' src='/image.jpg'>`,
+			expected: `<img alt='x' src='/https://example.com/image.jpg'>`,
+		},
+		{
+			name:     "unquoted attribute",
+			input:    `<img src=/image.jpg alt=x>`,
+			expected: `<img src="/https://example.com/image.jpg" alt=x>`,
+		},
+		{
+			name:     "path relative url",
+			input:    `<a href="next.html">next</a>`,
+			expected: `<a href="/https://example.com/articles/next.html">next</a>`,
+		},
+		{
+			name:     "protocol relative url",
+			input:    `<script src="//cdn.example.net/app.js"></script>`,
+			expected: `<script src="/https://cdn.example.net/app.js"></script>`,
+		},
+		{
+			name:     "absolute url",
+			input:    `<link rel="preload" href="http://static.example.com/font.woff2" as="font">`,
+			expected: `<link rel="preload" href="/http://static.example.com/font.woff2" as="font">`,
+		},
+		{
+			name:     "srcset",
+			input:    `<source srcset="/a.jpg 1x, /b.jpg 2x">`,
+			expected: `<source srcset="/https://example.com/a.jpg 1x, /https://example.com/b.jpg 2x">`,
+		},
+		{
+			name:     "video poster",
+			input:    `<video poster="/poster.png" src="/movie.mp4"></video>`,
+			expected: `<video poster="/https://example.com/poster.png" src="/https://example.com/movie.mp4"></video>`,
+		},
+		{
+			name:     "form action",
+			input:    `<form action="/search"><input name="q"></form>`,
+			expected: `<form action="/https://example.com/search"><input name="q"></form>`,
+		},
+		{
+			name:     "iframe",
+			input:    `<iframe src="https://player.example.org/embed/1"></iframe>`,
+			expected: `<iframe src="/https://player.example.org/embed/1"></iframe>`,
+		},
+		{
+			name:     "fragment, data and javascript urls are kept",
+			input:    `<a href="#top">top</a><img src="data:image/png;base64,AAAA"><a href="javascript:void(0)">x</a>`,
+			expected: `<a href="#top">top</a><img src="data:image/png;base64,AAAA"><a href="javascript:void(0)">x</a>`,
+		},
+		{
+			name:     "base href",
+			input:    `<base href="https://static.example.com/assets/"><img src="logo.png">`,
+			expected: `<base href="/https://static.example.com/assets/"><img src="/https://static.example.com/assets/logo.png">`,
+		},
+		{
+			name:     "style element",
+			input:    `<style>body { background: url("/bg.png") } @import '/print.css';</style>`,
+			expected: `<style>body { background: url("/https://example.com/bg.png") } @import '/https://example.com/print.css';</style>`,
+		},
+		{
+			name:     "meta refresh",
+			input:    `<meta http-equiv="refresh" content="0; url=/moved">`,
+			expected: `<meta http-equiv="refresh" content="0; url=/https://example.com/moved">`,
+		},
+		{
+			name:     "escaped query string",
+			input:    `<a href="/search?a=1&amp;b=2">s</a>`,
+			expected: `<a href="/https://example.com/search?a=1&amp;b=2">s</a>`,
+		},
+		{
+			name:     "script contents are untouched",
+			input:    `<script>var s = '<img src="/x.png">';</script>`,
+			expected: `<script>var s = '<img src="/x.png">';</script>`,
+		},
+		{
+			name:     "svg attribute case is preserved",
+			input:    `<svg viewBox="0 0 1 1"><use xlink:href="/sprite.svg#icon"></use></svg>`,
+			expected: `<svg viewBox="0 0 1 1"><use xlink:href="/https://example.com/sprite.svg#icon"></use></svg>`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := rewriteString(t, "https://example.com/articles/index.html", tc.input)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -13,7 +13,7 @@ func Ruleset(c *fiber.Ctx) error {
 		return c.SendString("Rules Disabled")
 	}
 
-	body, err := yaml.Marshal(rulesSet)
+	body, err := yaml.Marshal(rules.Load().Rules())
 	if err != nil {
 		c.SendStatus(fiber.StatusInternalServerError)
 		return c.SendString(err.Error())
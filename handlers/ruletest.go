@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/andesco/ladder/pkg/logging"
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// RunRuleTests runs the tests of the rules in rs against their fixtures and writes a report per domain to w.
+// Every test fetches its URL through the whole pipeline, with the upstream server replaced by the fixture,
+// so no request leaves the machine. rs replaces the current ruleset. It returns an error if a test failed.
+// Only warnings and errors are logged while the tests run, so that the request log does not mix with the report.
+func RunRuleTests(rs ruleset.RuleSet, w io.Writer) error {
+	useRuleset(rs)
+	logger := slog.New(logging.WithLevel(slog.Default().Handler(), slog.LevelWarn))
+
+	passed, failed := 0, 0
+	for _, rule := range rs {
+		if len(rule.Tests) == 0 {
+			continue
+		}
+
+		fmt.Fprintln(w, rule.Label())
+		for _, test := range rule.Tests {
+			problems, err := runRuleTest(rule, test, logger)
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+
+			if len(problems) == 0 {
+				passed++
+				fmt.Fprintf(w, "  PASS %s\n", test.URL)
+				continue
+			}
+
+			failed++
+			fmt.Fprintf(w, "  FAIL %s\n", test.URL)
+			for _, problem := range problems {
+				fmt.Fprintf(w, "       %s\n", problem)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%d passed, %d failed\n", passed, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d rule tests failed", failed)
+	}
+	return nil
+}
+
+// runRuleTest fetches the URL of test with the fixture as upstream response, and returns the failed assertions.
+func runRuleTest(rule ruleset.Rule, test ruleset.RuleTest, logger *slog.Logger) ([]string, error) {
+	fixture := test.Fixture
+	if !filepath.IsAbs(fixture) && rule.Source != "" {
+		fixture = filepath.Join(filepath.Dir(rule.Source), fixture)
+	}
+
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := fetchSite(test.URL, nil, fetchOptions{followRedirects: true, transport: fixtureTransport(data), logger: logger})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, selector := range test.Present {
+		if doc.Find(selector).Length() == 0 {
+			problems = append(problems, fmt.Sprintf("expected '%s' to be present", selector))
+		}
+	}
+	for _, selector := range test.Absent {
+		if n := doc.Find(selector).Length(); n > 0 {
+			problems = append(problems, fmt.Sprintf("expected '%s' to be absent, found %d", selector, n))
+		}
+	}
+	for _, text := range test.Contains {
+		if !bytes.Contains(body, []byte(text)) {
+			problems = append(problems, fmt.Sprintf("expected page to contain '%s'", text))
+		}
+	}
+
+	return problems, nil
+}
+
+// fixtureTransport answers every request with the recorded response in data. A recording that does not
+// start with a status line is the body of a 200 response.
+type fixtureTransport []byte
+
+func (f fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if bytes.HasPrefix(f, []byte("HTTP/")) {
+		r := bufio.NewReader(bytes.NewReader(f))
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fixture: %w", err)
+		}
+		// recordings are decoded already, and their length changes when they are edited,
+		// so the body is the rest of the recording
+		resp.Body = io.NopCloser(r)
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Transfer-Encoding")
+		resp.ContentLength = -1
+		resp.TransferEncoding = nil
+		return resp, nil
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {http.DetectContentType(f)}},
+		Body:          io.NopCloser(bytes.NewReader(f)),
+		ContentLength: int64(len(f)),
+		Request:       req,
+	}, nil
+}
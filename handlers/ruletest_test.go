@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRuleTests(t *testing.T) {
+	defer rules.Store(rules.Load())
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "page.html"), []byte(`<html><head></head><body><div class="paywall">pay</div><p>story</p></body></html>`), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "page.http"), []byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 3\r\n\r\n<html><body><p>recorded</p></body></html>"), 0o644))
+
+	source := filepath.Join(dir, "example-com.yaml")
+	rs := ruleset.RuleSet{
+		{
+			Domain: "example.com",
+			Source: source,
+			RegexRules: []ruleset.Regex{
+				{Match: `<div class="paywall">pay</div>`, Replace: ""},
+			},
+			Tests: []ruleset.RuleTest{
+				{URL: "https://example.com/a", Fixture: "page.html", Present: []string{"p"}, Absent: []string{".paywall"}, Contains: []string{"story"}},
+				{URL: "https://example.com/b", Fixture: "page.http", Present: []string{"p"}, Contains: []string{"recorded"}},
+			},
+		},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, RunRuleTests(rs, &out))
+	assert.Contains(t, out.String(), "example.com\n  PASS https://example.com/a\n  PASS https://example.com/b\n")
+	assert.Contains(t, out.String(), "2 passed, 0 failed")
+
+	rs[0].RegexRules = nil
+	rs[0].Tests[1].Fixture = "missing.http"
+	out.Reset()
+	assert.Error(t, RunRuleTests(rs, &out))
+	assert.Contains(t, out.String(), "  FAIL https://example.com/a\n       expected '.paywall' to be absent, found 1\n")
+	assert.Contains(t, out.String(), "  FAIL https://example.com/b\n")
+	assert.Contains(t, out.String(), "0 passed, 2 failed")
+}
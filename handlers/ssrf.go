@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/andesco/ladder/pkg/logging"
+)
+
+// ssrfGuard keeps sites from making ladder connect to the network it runs in, e.g. to
+// 127.0.0.1, to cloud metadata endpoints at 169.254.169.254 or to services next to it.
+var ssrfGuard = destinationGuardFromEnv()
+
+// errBlockedDestination is returned for connections to addresses that sites must not reach.
+var errBlockedDestination = errors.New("destination not allowed")
+
+var (
+	// cgnat is the shared address space of carrier-grade NAT, which netip does not treat as private.
+	cgnat = netip.MustParsePrefix("100.64.0.0/10")
+	// nat64 and sixToFour are IPv6 addresses that lead to the IPv4 address embedded in them.
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// destinationGuard checks the addresses upstream connections are made to.
+type destinationGuard struct {
+	// enabled rejects private, loopback, link-local, multicast, CGNAT and reserved addresses
+	enabled bool
+	// allowed are ranges that are allowed anyway
+	allowed []netip.Prefix
+}
+
+// destinationGuardFromEnv creates the guard from SSRF_PROTECTION and SSRF_ALLOWED_CIDRS.
+func destinationGuardFromEnv() destinationGuard {
+	g := destinationGuard{enabled: os.Getenv("SSRF_PROTECTION") != "false"}
+
+	allowed, err := parsePrefixes(os.Getenv("SSRF_ALLOWED_CIDRS"))
+	if err != nil {
+		slog.Error("ignoring invalid SSRF_ALLOWED_CIDRS", logging.Err(err))
+	}
+	g.allowed = allowed
+
+	return g
+}
+
+// parsePrefixes parses a comma separated list of CIDRs or single IP addresses.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// check returns an error wrapping errBlockedDestination if ip must not be connected to.
+func (g destinationGuard) check(ip netip.Addr) error {
+	if !g.enabled {
+		return nil
+	}
+
+	ip = ip.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+
+	if kind := addressKind(ip); kind != "" {
+		return fmt.Errorf("%w: %s is a %s address", errBlockedDestination, ip, kind)
+	}
+	if v4, ok := embeddedIPv4(ip); ok {
+		if kind := addressKind(v4); kind != "" {
+			return fmt.Errorf("%w: %s leads to %s, a %s address", errBlockedDestination, ip, v4, kind)
+		}
+	}
+	return nil
+}
+
+// embeddedIPv4 returns the IPv4 address that a NAT64 or 6to4 address leads to.
+func embeddedIPv4(ip netip.Addr) (netip.Addr, bool) {
+	b := ip.As16()
+	switch {
+	case nat64.Contains(ip):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(ip):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// addressKind returns what kind of non-public address ip is, or an empty string for public addresses.
+func addressKind(ip netip.Addr) string {
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate():
+		return "private"
+	case cgnat.Contains(ip):
+		return "CGNAT"
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	case ip.IsMulticast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast():
+		return "multicast"
+	case ip.IsUnspecified(), ip.Is4() && (ip.As4()[0] == 0 || ip.As4()[0] >= 240):
+		return "reserved"
+	default:
+		return ""
+	}
+}
+
+// controlDial checks the address right before a connection is made, after the host name was resolved.
+// Checking here, rather than the host name of a URL, also covers redirects and host names that
+// resolve to a different address on every lookup.
+func controlDial(_ context.Context, _ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	return ssrfGuard.check(ip)
+}
+
+// dialRouteKey is the context key of the dialRoute of a request.
+type dialRouteKey struct{}
+
+// dialRoute is the proxy the transport picked for the last request with a context, so that the dial
+// function can tell the connection to the proxy from connections to sites.
+type dialRoute struct {
+	// proxy is the host:port of the proxy, or empty if the request is not proxied
+	proxy atomic.Value
+}
+
+// withDialRoute returns a context for requests through guardedProxy and guardedDial.
+func withDialRoute(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dialRouteKey{}, &dialRoute{})
+}
+
+// isProxy reports whether the transport picked address as the proxy of the request with ctx.
+func isProxy(ctx context.Context, address string) bool {
+	route, ok := ctx.Value(dialRouteKey{}).(*dialRoute)
+	if !ok {
+		return false
+	}
+	proxy, _ := route.proxy.Load().(string)
+	return proxy != "" && proxy == address
+}
+
+// guardedDial returns a dial function that checks every address with the guard, except for connections
+// to the proxy that guardedProxy picked for the request, which is set up by the administrator.
+func guardedDial(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.ControlContext = controlDial
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if isProxy(ctx, address) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+}
+
+// guardedProxy wraps the proxy function of a transport. It records the proxy it picks for guardedDial.
+// Proxies resolve the host names of sites themselves, so for requests through a proxy only IP addresses
+// in URLs can be checked.
+func guardedProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+
+		if route, ok := req.Context().Value(dialRouteKey{}).(*dialRoute); ok {
+			addr := ""
+			if err == nil && proxyURL != nil {
+				addr = proxyAddr(proxyURL)
+			}
+			route.proxy.Store(addr)
+		}
+
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		if ip, err := netip.ParseAddr(req.URL.Hostname()); err == nil {
+			if err := ssrfGuard.check(ip); err != nil {
+				return nil, err
+			}
+		}
+		return proxyURL, nil
+	}
+}
+
+// proxyAddr returns the address a transport dials for proxyURL, with the default port of its scheme.
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxyURL.Scheme]
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// checkScheme returns an error if u is not a http or https URL.
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme '%s' is not allowed, only http and https", errBlockedDestination, u.Scheme)
+	}
+	return nil
+}
+
+// errorStatus returns the status code for a failed fetch.
+func errorStatus(err error) int {
+	if errors.Is(err, errBlockedDestination) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// the test servers listen on loopback addresses
+	ssrfGuard.allowed = append(ssrfGuard.allowed, netip.MustParsePrefix("127.0.0.0/8"))
+	os.Exit(m.Run())
+}
+
+func TestDestinationGuard(t *testing.T) {
+	g := destinationGuard{enabled: true}
+
+	blocked := map[string]string{
+		"127.0.0.1":        "loopback",
+		"::1":              "loopback",
+		"::ffff:127.0.0.1": "loopback",
+		"10.1.2.3":         "private",
+		"172.16.0.1":       "private",
+		"192.168.1.1":      "private",
+		"fd00::1":          "private",
+		"100.64.0.1":       "CGNAT",
+		"169.254.169.254":  "link-local",
+		"fe80::1":          "link-local",
+		"224.0.0.1":        "multicast",
+		"ff02::1":          "multicast",
+		"0.0.0.0":          "reserved",
+		"::":               "reserved",
+		"255.255.255.255":  "reserved",
+	}
+	for ip, kind := range blocked {
+		err := g.check(netip.MustParseAddr(ip))
+		assert.ErrorIs(t, err, errBlockedDestination, ip)
+		assert.ErrorContains(t, err, "is a "+kind+" address", ip)
+	}
+
+	// NAT64 and 6to4 addresses lead to the IPv4 address embedded in them
+	embedded := map[string]string{
+		"64:ff9b::a00:1":      "10.0.0.1, a private",
+		"64:ff9b::7f00:1":     "127.0.0.1, a loopback",
+		"2002:c0a8:101::1":    "192.168.1.1, a private",
+		"2002:a9fe:a9fe:1::1": "169.254.169.254, a link-local",
+	}
+	for ip, kind := range embedded {
+		err := g.check(netip.MustParseAddr(ip))
+		assert.ErrorIs(t, err, errBlockedDestination, ip)
+		assert.ErrorContains(t, err, "leads to "+kind+" address", ip)
+	}
+
+	for _, ip := range []string{"93.184.216.34", "100.128.0.1", "2606:2800:220:1:248:1893:25c8:1946", "64:ff9b::5db8:d822", "2002:5db8:d822::1"} {
+		assert.NoError(t, g.check(netip.MustParseAddr(ip)), ip)
+	}
+
+	g.allowed = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	assert.NoError(t, g.check(netip.MustParseAddr("10.1.2.3")))
+	assert.Error(t, g.check(netip.MustParseAddr("192.168.1.1")))
+
+	g.enabled = false
+	assert.NoError(t, g.check(netip.MustParseAddr("127.0.0.1")))
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes("10.0.0.0/8, 192.168.1.5,fd00::/8 ,")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.5/32"),
+		netip.MustParsePrefix("fd00::/8"),
+	}, prefixes)
+
+	_, err = parsePrefixes("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestProxyAddr(t *testing.T) {
+	for proxy, want := range map[string]string{
+		"socks5://127.0.0.1:9050": "127.0.0.1:9050",
+		"socks5://tor":            "tor:1080",
+		"http://proxy":            "proxy:80",
+		"https://[::1]":           "[::1]:443",
+	} {
+		u, _ := url.Parse(proxy)
+		assert.Equal(t, want, proxyAddr(u), proxy)
+	}
+}
+
+func TestGuardedDialProxy(t *testing.T) {
+	defer func(g destinationGuard) { ssrfGuard = g }(ssrfGuard)
+	ssrfGuard = destinationGuard{enabled: true}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.Host))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	dialer := &net.Dialer{}
+	get := func(t *http.Transport, ctx context.Context, target string) (string, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		resp, err := (&http.Client{Transport: t}).Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// the connection to the proxy is allowed, sites through it are checked by their IP address
+	proxied := &http.Transport{Proxy: guardedProxy(http.ProxyURL(proxyURL)), DialContext: guardedDial(dialer)}
+	body, err := get(proxied, withDialRoute(context.Background()), "http://93.184.216.34/page")
+	assert.NoError(t, err)
+	assert.Equal(t, "proxied 93.184.216.34", body)
+
+	_, err = get(proxied, withDialRoute(context.Background()), "http://10.0.0.1/page")
+	assert.ErrorIs(t, err, errBlockedDestination)
+
+	// the proxy's address is checked if it is not connected to as the proxy
+	direct := &http.Transport{Proxy: guardedProxy(func(*http.Request) (*url.URL, error) { return nil, nil }), DialContext: guardedDial(dialer)}
+	_, err = get(direct, withDialRoute(context.Background()), proxy.URL+"/page")
+	assert.ErrorIs(t, err, errBlockedDestination)
+
+	_, err = get(&http.Transport{DialContext: guardedDial(dialer)}, context.Background(), proxy.URL+"/page")
+	assert.ErrorIs(t, err, errBlockedDestination)
+}
+
+func TestFetchSiteSSRF(t *testing.T) {
+	defer func(g destinationGuard) { ssrfGuard = g }(ssrfGuard)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "http://[::1]:1/internal", http.StatusFound)
+		case "/scheme":
+			http.Redirect(w, r, "ftp://example.com/file", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer upstream.Close()
+
+	// the test server is only reachable if it is allowed
+	ssrfGuard = destinationGuard{enabled: true}
+	_, err := fetchSite(upstream.URL+"/page", nil, fetchOptions{followRedirects: true})
+	assert.ErrorIs(t, err, errBlockedDestination)
+	assert.ErrorContains(t, err, "127.0.0.1 is a loopback address")
+
+	ssrfGuard.allowed = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	res, err := fetchSite(upstream.URL+"/page", nil, fetchOptions{followRedirects: true})
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	// redirects are checked when they are followed
+	_, err = fetchSite(upstream.URL+"/redirect", nil, fetchOptions{followRedirects: true})
+	assert.ErrorIs(t, err, errBlockedDestination)
+	assert.ErrorContains(t, err, "::1 is a loopback address")
+
+	_, err = fetchSite(upstream.URL+"/scheme", nil, fetchOptions{followRedirects: true})
+	assert.ErrorIs(t, err, errBlockedDestination)
+	assert.ErrorContains(t, err, "scheme 'ftp' is not allowed")
+
+	_, err = fetchSite("file:///etc/passwd", nil, fetchOptions{followRedirects: true})
+	assert.ErrorIs(t, err, errBlockedDestination)
+
+	// the proxy is blocked with 403. Pooled connections were checked when they were made.
+	ssrfGuard.allowed = nil
+	ConfigureTransport(transportConfig)
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/page", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusForbidden, errorStatus(&url.Error{Op: "Get", Err: errBlockedDestination}))
+	assert.Equal(t, http.StatusInternalServerError, errorStatus(errors.New("timeout")))
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andesco/ladder/pkg/cache"
+	"github.com/andesco/ladder/pkg/logging"
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// maxInspectSize is the number of bytes of a response that are read to check a strategy's
+// success conditions. Larger responses are judged by their beginning.
+const maxInspectSize = 10 << 20
+
+// fetchUpstream requests target from the upstream server. If the rule declares strategies, they
+// are tried in order until one of them meets its success condition, otherwise the response of the
+// last strategy is returned. It also returns the name of the strategy that produced the response,
+// which is empty for rules without strategies.
+func fetchUpstream(client *http.Client, target string, u *url.URL, rule ruleset.Rule, timeout time.Duration, opts fetchOptions, stale *cache.Entry) (*http.Request, *http.Response, string, error) {
+	if len(rule.Strategies) == 0 {
+		req, resp, err := fetchAttempt(client, target, u, rule, ruleset.Strategy{}, timeout, opts, stale)
+		return req, resp, "", err
+	}
+
+	for i, strategy := range rule.Strategies {
+		name := strategyName(i, strategy)
+		last := i == len(rule.Strategies)-1
+
+		req, resp, err := fetchAttempt(client, target, u, rule, strategy, timeout, opts, stale)
+		if err != nil {
+			if last {
+				return nil, nil, name, err
+			}
+			opts.log().Warn("strategy failed", "strategy", name, logging.Private("host", u.Host), logging.Err(err))
+			continue
+		}
+
+		if stale != nil && resp.StatusCode == http.StatusNotModified {
+			return req, resp, name, nil
+		}
+
+		ok, err := strategySucceeded(resp, successFor(rule, strategy))
+		if err == nil && (ok || last) {
+			return req, resp, name, nil
+		}
+
+		resp.Body.Close()
+		if last {
+			return nil, nil, name, err
+		}
+	}
+
+	// unreachable, the last strategy always returns
+	return nil, nil, "", fmt.Errorf("no strategy for %s", u.Host)
+}
+
+// fetchAttempt requests target with a single strategy applied. The timeout covers the time until the
+// response headers arrive. The body is streamed for as long as the client keeps reading it, but every
+// read of it fails if the site sends nothing for transportConfig.ReadTimeout.
+func fetchAttempt(client *http.Client, target string, u *url.URL, rule ruleset.Rule, strategy ruleset.Strategy, timeout time.Duration, opts fetchOptions, stale *cache.Entry) (*http.Request, *http.Response, error) {
+	if strategy.URL != "" {
+		var err error
+		target, err = strategyURL(strategy.URL, target)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// a mirror's redirects lead to its copy of the page and are always followed
+	follow := opts.followRedirects || strategy.URL != ""
+
+	ctx := withDialRoute(withRedirectPolicy(context.Background(), follow))
+	if opts.timings != nil {
+		ctx = opts.timings.withTrace(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+
+	req := newUpstreamRequest(ctx, target, u, rule)
+
+	if strategy.UserAgent != "" {
+		req.Header.Set("User-Agent", strategy.UserAgent)
+	}
+
+	switch strategy.Referer {
+	case "":
+	case "none":
+		req.Header.Del("Referer")
+	default:
+		req.Header.Set("Referer", strategy.Referer)
+	}
+
+	// the validators of the entry are meaningless to other upstreams, like the mirror of another strategy
+	if stale != nil && stale.Source == req.URL.String() {
+		revalidate(req, stale)
+	}
+
+	resp, err := client.Do(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	upstream := resp.Body
+	var body io.Reader = upstream
+	if readTimeout := transportConfig.ReadTimeout; readTimeout > 0 {
+		body = deadlineReader{upstream, timer, readTimeout}
+	}
+	resp.Body = readCloser{body, func() error {
+		defer cancel()
+		return upstream.Close()
+	}}
+
+	return req, resp, nil
+}
+
+// deadlineReader cancels the request through timer when a read takes longer than timeout. Only the
+// time spent waiting for the site counts, not the time the client takes between reads.
+type deadlineReader struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	defer r.timer.Stop()
+	return r.Reader.Read(p)
+}
+
+// strategyName returns the name a strategy is reported with.
+func strategyName(i int, strategy ruleset.Strategy) string {
+	if strategy.Name != "" {
+		return strategy.Name
+	}
+	return fmt.Sprintf("strategy-%d", i+1)
+}
+
+// strategyURL fills in a strategy's URL template for the target URL.
+// Supported placeholders are {url}, {url_encoded}, {scheme}, {host}, {path} and {query}.
+func strategyURL(template string, target string) (string, error) {
+	t, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	r := strings.NewReplacer(
+		"{url}", target,
+		"{url_encoded}", url.QueryEscape(target),
+		"{scheme}", t.Scheme,
+		"{host}", t.Host,
+		"{path}", t.EscapedPath(),
+		"{query}", t.RawQuery,
+	)
+
+	return r.Replace(template), nil
+}
+
+// successFor returns the success condition of a strategy, falling back to the rule's one.
+func successFor(rule ruleset.Rule, strategy ruleset.Strategy) ruleset.Success {
+	if len(strategy.Success.Status) > 0 || strategy.Success.Selector != "" || strategy.Success.MinLength > 0 {
+		return strategy.Success
+	}
+	return rule.Success
+}
+
+// strategySucceeded reports whether a response meets the success condition. Without a status list,
+// any status below 400 is a success. Checking the selector or the minimum length reads the beginning
+// of the body, which is put back in front of the rest of resp.Body.
+func strategySucceeded(resp *http.Response, success ruleset.Success) (bool, error) {
+	if len(success.Status) > 0 {
+		found := false
+		for _, status := range success.Status {
+			found = found || status == resp.StatusCode
+		}
+		if !found {
+			return false, nil
+		}
+	} else if resp.StatusCode >= 400 {
+		return false, nil
+	}
+
+	if success.Selector == "" && success.MinLength == 0 {
+		return true, nil
+	}
+
+	head, err := io.ReadAll(io.LimitReader(resp.Body, maxInspectSize))
+	upstream := resp.Body
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(head), upstream), upstream.Close}
+	if err != nil {
+		return false, err
+	}
+
+	if len(head) < success.MinLength {
+		return false, nil
+	}
+
+	if success.Selector != "" {
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(head))
+		if err != nil || doc.Find(success.Selector).Length() == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andesco/ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrategyURL(t *testing.T) {
+	target := "https://www.example.com/news/article?id=1"
+
+	testCases := map[string]string{
+		"https://archive.org/wait/{url}":       "https://archive.org/wait/https://www.example.com/news/article?id=1",
+		"https://mirror.test/?u={url_encoded}": "https://mirror.test/?u=https%3A%2F%2Fwww.example.com%2Fnews%2Farticle%3Fid%3D1",
+		"{scheme}://{host}/amp{path}?{query}":  "https://www.example.com/amp/news/article?id=1",
+	}
+
+	for template, expected := range testCases {
+		actual, err := strategyURL(template, target)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, template)
+	}
+}
+
+func TestFetchSiteStrategies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+
+		switch {
+		case r.URL.Path == "/mirror":
+			io.WriteString(w, `<article><p>mirrored copy of `+r.URL.Query().Get("u")+`</p></article>`)
+		case r.URL.Path == "/social" && r.Header.Get("Referer") == "https://t.co/":
+			io.WriteString(w, `<article><p>full text</p></article>`)
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			io.WriteString(w, `<div class="paywall">subscribe</div>`)
+		}
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+
+	defer rules.Store(rules.Load())
+	rule := ruleset.Rule{
+		Domain:  u.Host,
+		Success: ruleset.Success{Selector: "article p"},
+		Strategies: []ruleset.Strategy{
+			{Name: "googlebot", UserAgent: "Googlebot/2.1"},
+			{Name: "social", Referer: "https://t.co/"},
+			{Name: "mirror", URL: upstream.URL + "/mirror?u={url_encoded}"},
+		},
+	}
+	useRuleset(ruleset.RuleSet{rule})
+
+	body, resp := fetchString(t, upstream.URL+"/social")
+	assert.Equal(t, "social", resp.Header.Get("X-Ladder-Strategy"))
+	assert.Contains(t, body, "full text")
+
+	body, resp = fetchString(t, upstream.URL+"/other")
+	assert.Equal(t, "mirror", resp.Header.Get("X-Ladder-Strategy"))
+	assert.Contains(t, body, "mirrored copy of "+upstream.URL+"/other")
+
+	// status conditions
+	rule.Success = ruleset.Success{Status: []int{http.StatusOK}}
+	rule.Strategies = []ruleset.Strategy{
+		{Name: "direct"},
+		{Name: "mirror", URL: upstream.URL + "/mirror?u={url_encoded}"},
+	}
+	useRuleset(ruleset.RuleSet{rule})
+
+	_, resp = fetchString(t, upstream.URL+"/gone")
+	assert.Equal(t, "mirror", resp.Header.Get("X-Ladder-Strategy"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the last strategy's response is returned when none succeeds
+	rule.Strategies = rule.Strategies[:1]
+	useRuleset(ruleset.RuleSet{rule})
+	_, resp = fetchString(t, upstream.URL+"/gone")
+	assert.Equal(t, "direct", resp.Header.Get("X-Ladder-Strategy"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// fetchTimings measures where the time of a fetch goes. Durations of several attempts,
+// e.g. redirects or strategies, are added up.
+type fetchTimings struct {
+	mu sync.Mutex
+
+	// DNS is the time spent resolving host names
+	DNS time.Duration
+	// Connect is the time spent establishing TCP connections
+	Connect time.Duration
+	// TLS is the time spent in TLS handshakes
+	TLS time.Duration
+	// TTFB is the time from sending a request until the first byte of its response arrived
+	TTFB time.Duration
+	// Rewrite is the time from the response headers until the rewritten body was complete,
+	// which includes reading the body from the site
+	Rewrite time.Duration
+}
+
+// withTrace returns a context that records the timings of the requests made with it in t.
+func (t *fetchTimings) withTrace(ctx context.Context) context.Context {
+	var dnsStart, connectStart, tlsStart, requestSent time.Time
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.start(&dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.since(&t.DNS, &dnsStart) },
+		ConnectStart:         func(string, string) { t.start(&connectStart) },
+		ConnectDone:          func(string, string, error) { t.since(&t.Connect, &connectStart) },
+		TLSHandshakeStart:    func() { t.start(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.since(&t.TLS, &tlsStart) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.start(&requestSent) },
+		GotFirstResponseByte: func() { t.since(&t.TTFB, &requestSent) },
+	})
+}
+
+// start sets start to now. The trace callbacks may run in several goroutines.
+func (t *fetchTimings) start(start *time.Time) {
+	t.mu.Lock()
+	*start = time.Now()
+	t.mu.Unlock()
+}
+
+// since adds the time since start to d.
+func (t *fetchTimings) since(d *time.Duration, start *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !start.IsZero() {
+		*d += time.Since(*start)
+	}
+}
+
+// add adds the time since start to d.
+func (t *fetchTimings) add(d *time.Duration, start time.Time) {
+	t.mu.Lock()
+	*d += time.Since(start)
+	t.mu.Unlock()
+}
+
+// report returns the timings in milliseconds, with total as the duration of the whole fetch.
+func (t *fetchTimings) report(total time.Duration) Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Timings{
+		DNS:     milliseconds(t.DNS),
+		Connect: milliseconds(t.Connect),
+		TLS:     milliseconds(t.TLS),
+		TTFB:    milliseconds(t.TTFB),
+		Rewrite: milliseconds(t.Rewrite),
+		Total:   milliseconds(total),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
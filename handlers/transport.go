@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
+)
+
+var (
+	// outboundProxy routes all upstream requests through a http, https or socks5 proxy, e.g. socks5://127.0.0.1:9050 for Tor.
+	// Rules can override it with their own `proxy`, or bypass it with `proxy: direct`.
+	outboundProxy = os.Getenv("OUTBOUND_PROXY")
+
+	// transportConfig holds the settings every upstream transport is created with.
+	transportConfig = TransportConfigFromEnv()
+
+	// clients holds one long-lived *http.Client per outbound proxy. Each client has its own
+	// transport, so connections are pooled per route and reused across requests.
+	clients sync.Map
+)
+
+// TransportConfig holds the settings of the connections to upstream servers.
+type TransportConfig struct {
+	// Timeout bounds the time until the response headers arrive. Rules can override it.
+	Timeout time.Duration
+	// ReadTimeout bounds the time a site may take to send the next part of a response body.
+	ReadTimeout time.Duration
+	// DialTimeout bounds the time to establish a TCP connection.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the time of the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes. Negative disables them.
+	KeepAlive time.Duration
+	// IdleConnTimeout is how long an idle connection is kept in the pool.
+	IdleConnTimeout time.Duration
+	// MaxIdleConns limits the number of idle connections across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the number of idle connections kept per host.
+	MaxIdleConnsPerHost int
+	// DisableKeepAlives uses a new connection for every request.
+	DisableKeepAlives bool
+	// DisableHTTP2 restricts upstream connections to HTTP/1.1.
+	DisableHTTP2 bool
+}
+
+// TransportConfigFromEnv returns the transport settings from the environment, with defaults for anything unset.
+// Durations are either a number of seconds or a Go duration string like "1m30s".
+func TransportConfigFromEnv() TransportConfig {
+	return TransportConfig{
+		Timeout:             getenvDuration("HTTP_TIMEOUT", 15*time.Second),
+		ReadTimeout:         getenvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		DialTimeout:         getenvDuration("HTTP_DIAL_TIMEOUT", 10*time.Second),
+		TLSHandshakeTimeout: getenvDuration("HTTP_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		KeepAlive:           getenvDuration("HTTP_KEEPALIVE", 30*time.Second),
+		IdleConnTimeout:     getenvDuration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		MaxIdleConns:        getenvInt("HTTP_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost: getenvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 10),
+		DisableKeepAlives:   os.Getenv("HTTP_DISABLE_KEEPALIVES") == "true",
+		DisableHTTP2:        os.Getenv("HTTP2") == "false",
+	}
+}
+
+// ConfigureTransport replaces the transport settings. Pooled connections created with the
+// previous settings are closed.
+func ConfigureTransport(cfg TransportConfig) {
+	transportConfig = cfg
+
+	clients.Range(func(key, value any) bool {
+		clients.Delete(key)
+		value.(*http.Client).CloseIdleConnections()
+		return true
+	})
+}
+
+// ParseDuration parses a duration that is either a number of seconds or a Go duration string.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func init() {
+	if outboundProxy == "" {
+		return
+	}
+	if _, err := parseProxyURL(outboundProxy); err != nil {
+		slog.Error("invalid OUTBOUND_PROXY", logging.Err(err))
+	}
+}
+
+// followRedirectsKey is the context key of the per-request redirect policy.
+type followRedirectsKey struct{}
+
+// clientFor returns the shared client for a rule's proxy setting. An empty proxy
+// uses OUTBOUND_PROXY, "direct" connects to the upstream server without any proxy.
+func clientFor(proxy string) (*http.Client, error) {
+	if proxy == "" {
+		proxy = outboundProxy
+	}
+
+	if c, ok := clients.Load(proxy); ok {
+		return c.(*http.Client), nil
+	}
+
+	t, err := newTransport(proxy, transportConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if follow, ok := req.Context().Value(followRedirectsKey{}).(bool); ok && !follow {
+				return http.ErrUseLastResponse
+			}
+			if err := checkScheme(req.URL); err != nil {
+				return err
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return nil
+		},
+	}
+
+	actual, _ := clients.LoadOrStore(proxy, c)
+	return actual.(*http.Client), nil
+}
+
+// withRedirectPolicy returns a context that makes the shared clients follow redirects or return them.
+func withRedirectPolicy(ctx context.Context, follow bool) context.Context {
+	return context.WithValue(ctx, followRedirectsKey{}, follow)
+}
+
+// newTransport creates a transport that connects through the given proxy URL.
+func newTransport(proxy string, cfg TransportConfig) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           guardedDial(dialer),
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if cfg.DisableHTTP2 {
+		// a non-nil, empty map disables the HTTP/2 upgrade
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	switch proxy {
+	case "":
+		// keep honoring HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+		t.Proxy = guardedProxy(http.ProxyFromEnvironment)
+	case "direct":
+		t.Proxy = nil
+	default:
+		proxyURL, err := parseProxyURL(proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = guardedProxy(http.ProxyURL(proxyURL))
+	}
+
+	return t, nil
+}
+
+// parseProxyURL parses and validates an outbound proxy URL.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound proxy '%s': %w", proxy, err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		// socks5 already resolves host names on the proxy
+		proxyURL.Scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("invalid outbound proxy '%s': scheme must be one of http, https, socks5", proxy)
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid outbound proxy '%s': missing host", proxy)
+	}
+
+	return proxyURL, nil
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Entry is a cached upstream response. Body holds the response as it was sent to the
+// client, after the ruleset has been applied.
+type Entry struct {
+	// URL is the URL that was requested through ladder, see NormalizeURL. It is used to purge entries.
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"-"`
+	StoredAt   time.Time   `json:"storedAt"`
+	Expires    time.Time   `json:"expires"`
+	// Source is the URL the response was requested from, e.g. a mirror's URL. Its validators only
+	// apply to requests for the same URL.
+	Source string `json:"source,omitempty"`
+}
+
+// Store is a key value store for cached responses.
+type Store interface {
+	// Get returns the entry stored under key, including expired entries.
+	Get(key string) (*Entry, bool)
+	// Set stores an entry under key, replacing any previous entry.
+	Set(key string, e *Entry) error
+	// Delete removes the entry stored under key.
+	Delete(key string)
+	// Purge removes every entry for which match returns true and returns the number of removed entries.
+	Purge(match func(e *Entry) bool) int
+}
+
+// Key derives a store key from its parts, such as the upstream URL and the applied rule.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fresh reports whether the entry can be served without asking the upstream server.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Revalidatable reports whether the upstream server can be asked if a stale entry is still valid.
+func (e *Entry) Revalidatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// MatchExpired returns a Purge matcher for entries that expired before now. Entries that can be
+// revalidated are kept for keepStale after they expired, so that their site can confirm them.
+func MatchExpired(now time.Time, keepStale time.Duration) func(e *Entry) bool {
+	return func(e *Entry) bool {
+		if e.Revalidatable() {
+			return !e.Fresh(now.Add(-keepStale))
+		}
+		return !e.Fresh(now)
+	}
+}
+
+// NormalizeURL returns u with a lower case host, its query parameters sorted by name and without fragment,
+// so that the same page has the same URL however its query was written.
+func NormalizeURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.RawQuery = parsed.Query().Encode()
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+// MatchURL returns a Purge matcher for entries of the given URL. URLs are compared after NormalizeURL.
+func MatchURL(u string) func(e *Entry) bool {
+	u = NormalizeURL(u)
+	return func(e *Entry) bool {
+		return NormalizeURL(e.URL) == u
+	}
+}
+
+// MatchDomain returns a Purge matcher for entries of the given domain and its subdomains.
+func MatchDomain(domain string) func(e *Entry) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return func(e *Entry) bool {
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return false
+		}
+		host := strings.ToLower(u.Hostname())
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEntry(u string, body string) *Entry {
+	return &Entry{
+		URL:        u,
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       []byte(body),
+		StoredAt:   time.Now(),
+		Expires:    time.Now().Add(time.Minute),
+	}
+}
+
+// testStore runs the behavior every Store implementation has to provide.
+func testStore(t *testing.T, s Store) {
+	_, ok := s.Get("missing")
+	assert.False(t, ok)
+
+	assert.NoError(t, s.Set("a", newEntry("https://www.example.com/a", "body a")))
+	assert.NoError(t, s.Set("b", newEntry("https://news.example.com/b", "body b")))
+	assert.NoError(t, s.Set("c", newEntry("https://www.example.org/c", "body c")))
+
+	e, ok := s.Get("a")
+	if assert.True(t, ok) {
+		assert.Equal(t, "body a", string(e.Body))
+		assert.Equal(t, "text/html", e.Header.Get("Content-Type"))
+		assert.True(t, e.Fresh(time.Now()))
+	}
+
+	s.Delete("a")
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+
+	assert.Equal(t, 1, s.Purge(MatchURL("https://www.example.org/c")))
+	_, ok = s.Get("c")
+	assert.False(t, ok)
+
+	// query parameters match in any order
+	assert.NoError(t, s.Set("d", newEntry(NormalizeURL("https://www.example.org/d?b=2&a=1"), "body d")))
+	assert.Equal(t, 1, s.Purge(MatchURL("https://WWW.example.org/d?a=1&b=2")))
+	_, ok = s.Get("d")
+	assert.False(t, ok)
+
+	assert.NoError(t, s.Set("a", newEntry("https://www.example.com/a", "body a")))
+	assert.Equal(t, 2, s.Purge(MatchDomain("example.com")))
+	_, ok = s.Get("b")
+	assert.False(t, ok)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory(1<<20))
+}
+
+func TestMemoryEviction(t *testing.T) {
+	m := NewMemory(10)
+
+	m.Set("a", newEntry("https://example.com/a", "12345"))
+	m.Set("b", newEntry("https://example.com/b", "12345"))
+	m.Get("a")
+	m.Set("c", newEntry("https://example.com/c", "12345"))
+
+	_, ok := m.Get("a")
+	assert.True(t, ok, "recently used entry should be kept")
+	_, ok = m.Get("b")
+	assert.False(t, ok, "least recently used entry should be evicted")
+	_, ok = m.Get("c")
+	assert.True(t, ok)
+}
+
+func TestDisk(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDisk(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %s", err)
+	}
+
+	testStore(t, d)
+}
+
+func TestDiskEviction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// room for two entries with their metadata
+	entrySize := func(e *Entry) int64 {
+		meta, _ := json.Marshal(e)
+		return int64(len(meta) + len(e.Body))
+	}
+	d, err := NewDisk(dir, 2*entrySize(newEntry("https://example.com/a", "12345"))+10)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %s", err)
+	}
+
+	d.Set("a", newEntry("https://example.com/a", "12345"))
+	d.Set("b", newEntry("https://example.com/b", "12345"))
+	d.Get("a")
+	d.Set("c", newEntry("https://example.com/c", "12345"))
+
+	_, ok := d.Get("a")
+	assert.True(t, ok, "recently used entry should be kept")
+	_, ok = d.Get("b")
+	assert.False(t, ok, "least recently used entry should be evicted")
+	_, err = os.Stat(filepath.Join(dir, "b.body"))
+	assert.True(t, os.IsNotExist(err), "files of evicted entry should be removed")
+
+	// the entries in the directory count against the limit of a new store
+	d, err = NewDisk(dir, d.maxBytes)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %s", err)
+	}
+	assert.Equal(t, 2, d.lru.Len())
+	d.Set("d", newEntry("https://example.com/d", "12345"))
+	assert.Equal(t, 2, d.lru.Len())
+}
+
+func TestMatchExpired(t *testing.T) {
+	now := time.Now()
+	expired := func(e *Entry) bool {
+		return MatchExpired(now, time.Hour)(e)
+	}
+
+	e := newEntry("https://example.com", "")
+	assert.False(t, expired(e))
+
+	e.Expires = now.Add(-time.Minute)
+	assert.True(t, expired(e))
+
+	// entries that can be revalidated are kept for a while
+	e.Header.Set("ETag", `"v1"`)
+	assert.False(t, expired(e))
+	e.Expires = now.Add(-2 * time.Hour)
+	assert.True(t, expired(e))
+}
+
+func TestEntryRevalidatable(t *testing.T) {
+	e := newEntry("https://example.com", "")
+	assert.False(t, e.Revalidatable())
+
+	e.Header.Set("ETag", `"v1"`)
+	assert.True(t, e.Revalidatable())
+
+	e.Expires = time.Now().Add(-time.Second)
+	assert.False(t, e.Fresh(time.Now()))
+}
@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk is a Store that keeps every entry as a pair of files in a directory:
+// <key>.json holds the metadata and <key>.body the response body.
+// Once the files take more than its limit, the least recently used entries are removed.
+type Disk struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type diskItem struct {
+	key  string
+	size int64
+}
+
+// NewDisk creates a Store in dir holding at most maxBytes of files, creating the directory if needed.
+// Entries already in dir are kept, the most recently written ones first.
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		e := fmt.Errorf("failed to create cache directory '%s'", dir)
+		return nil, errors.Join(e, err)
+	}
+
+	d := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+
+	if err := d.load(); err != nil {
+		e := fmt.Errorf("failed to read cache directory '%s'", dir)
+		return nil, errors.Join(e, err)
+	}
+
+	return d, nil
+}
+
+// load indexes the entries in the directory and removes the oldest ones if they exceed the limit.
+func (d *Disk) load() error {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var found []file
+
+	for _, path := range files {
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+		size, modTime, err := d.stat(key)
+		if err != nil {
+			// an entry without its body is of no use
+			d.removeFiles(key)
+			continue
+		}
+		found = append(found, file{key, size, modTime})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, f := range found {
+		d.add(f.key, f.size)
+	}
+	d.evict()
+
+	return nil
+}
+
+func (d *Disk) Get(key string) (*Entry, bool) {
+	e, err := d.readMeta(key)
+	if err != nil {
+		return nil, false
+	}
+
+	e.Body, err = os.ReadFile(d.path(key, ".body"))
+	if err != nil {
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.items[key]; ok {
+		d.lru.MoveToFront(el)
+	}
+
+	return e, true
+}
+
+func (d *Disk) Set(key string, e *Entry) error {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// the body is written first, so that a readable .json always has its .body
+	if err := writeFileAtomic(d.path(key, ".body"), e.Body); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(d.path(key, ".json"), meta); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.remove(key)
+	d.add(key, int64(len(meta)+len(e.Body)))
+	d.evict()
+
+	return nil
+}
+
+func (d *Disk) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.remove(key)
+	d.removeFiles(key)
+}
+
+func (d *Disk) Purge(match func(e *Entry) bool) int {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, file := range files {
+		key := strings.TrimSuffix(filepath.Base(file), ".json")
+
+		e, err := d.readMeta(key)
+		if err != nil || !match(e) {
+			continue
+		}
+
+		d.Delete(key)
+		n++
+	}
+
+	return n
+}
+
+// add indexes an entry as the most recently used one, the caller must hold the lock.
+func (d *Disk) add(key string, size int64) {
+	d.items[key] = d.lru.PushFront(&diskItem{key: key, size: size})
+	d.size += size
+}
+
+// remove drops an entry from the index, the caller must hold the lock.
+func (d *Disk) remove(key string) {
+	el, ok := d.items[key]
+	if !ok {
+		return
+	}
+
+	d.lru.Remove(el)
+	delete(d.items, key)
+	d.size -= el.Value.(*diskItem).size
+}
+
+// evict removes the least recently used entries until the limit is kept, the caller must hold the lock.
+func (d *Disk) evict() {
+	for d.size > d.maxBytes && d.lru.Len() > 0 {
+		key := d.lru.Back().Value.(*diskItem).key
+		d.remove(key)
+		d.removeFiles(key)
+	}
+}
+
+func (d *Disk) removeFiles(key string) {
+	os.Remove(d.path(key, ".json"))
+	os.Remove(d.path(key, ".body"))
+}
+
+// stat returns the size of the files of an entry, and the time it was written.
+func (d *Disk) stat(key string) (int64, time.Time, error) {
+	meta, err := os.Stat(d.path(key, ".json"))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	body, err := os.Stat(d.path(key, ".body"))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return meta.Size() + body.Size(), meta.ModTime(), nil
+}
+
+func (d *Disk) readMeta(key string) (*Entry, error) {
+	meta, err := os.ReadFile(d.path(key, ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entry{}
+	if err := json.Unmarshal(meta, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (d *Disk) path(key, ext string) string {
+	return filepath.Join(d.dir, key+ext)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path,
+// so that concurrent readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
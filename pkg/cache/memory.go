@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is an in-memory Store that evicts the least recently used entries
+// once the total size of the cached bodies exceeds its limit.
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// NewMemory creates an in-memory Store holding at most maxBytes of response bodies.
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (m *Memory) Get(key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (m *Memory) Set(key string, e *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+
+	m.entries[key] = m.lru.PushFront(&memoryItem{key: key, entry: e})
+	m.size += int64(len(e.Body))
+
+	for m.size > m.maxBytes && m.lru.Len() > 0 {
+		m.remove(m.lru.Back().Value.(*memoryItem).key)
+	}
+
+	return nil
+}
+
+func (m *Memory) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+}
+
+func (m *Memory) Purge(match func(e *Entry) bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key, el := range m.entries {
+		if match(el.Value.(*memoryItem).entry) {
+			m.remove(key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// remove deletes an entry, the caller must hold the lock.
+func (m *Memory) remove(key string) {
+	el, ok := m.entries[key]
+	if !ok {
+		return
+	}
+
+	m.lru.Remove(el)
+	delete(m.entries, key)
+	m.size -= int64(len(el.Value.(*memoryItem).entry.Body))
+}
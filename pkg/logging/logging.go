@@ -0,0 +1,149 @@
+// Package logging configures the default slog logger of ladder from the environment.
+//
+// LOG_LEVEL is the lowest level that is logged: debug, info, warn or error.
+// LOG_FORMAT is text or json.
+// LOG_URLS controls what is logged of the sites that are visited, see Private.
+//
+// The logger is configured when the package is initialized, so that packages importing it
+// log in the configured format from their own initialization on.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	// URLsShown logs URLs, hosts and rules as they are
+	URLsShown = "true"
+	// URLsHashed logs a short hash instead, so that requests for the same page can be told apart without revealing it
+	URLsHashed = "hash"
+	// URLsOmitted leaves them out
+	URLsOmitted = "false"
+)
+
+// urlMode is one of URLsShown, URLsHashed and URLsOmitted.
+var urlMode = URLsOmitted
+
+func init() {
+	level, levelErr := ParseLevel(os.Getenv("LOG_LEVEL"))
+	if _, ok := os.LookupEnv("LOG_LEVEL"); !ok && os.Getenv("NOLOGS") == "true" {
+		// NOLOGS used to turn off the request log, which is logged at info
+		level = slog.LevelWarn
+	}
+
+	handler, formatErr := NewHandler(os.Stderr, os.Getenv("LOG_FORMAT"), level)
+	slog.SetDefault(slog.New(handler))
+
+	mode, modeErr := parseURLMode(os.Getenv("LOG_URLS"))
+	urlMode = mode
+
+	for _, err := range []error{levelErr, formatErr, modeErr} {
+		if err != nil {
+			slog.Warn("ignoring invalid log setting", Err(err))
+		}
+	}
+}
+
+// ParseLevel parses debug, info, warn or error. An empty string is info.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level '%s', use debug, info, warn or error", s)
+	}
+}
+
+// NewHandler returns a handler that writes records of level and above to w, in the text or json format.
+// An unknown format falls back to text.
+func NewHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return slog.NewTextHandler(w, opts), fmt.Errorf("unknown log format '%s', use text or json", format)
+	}
+}
+
+// WithLevel returns a handler that passes the records of level and above on to h.
+func WithLevel(h slog.Handler, level slog.Level) slog.Handler {
+	return levelHandler{Handler: h, level: level}
+}
+
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// parseURLMode parses true, hash or false. Visited sites are only logged if asked for, so an empty
+// or unknown setting leaves them out.
+func parseURLMode(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true":
+		return URLsShown, nil
+	case "hash":
+		return URLsHashed, nil
+	case "", "false":
+		return URLsOmitted, nil
+	default:
+		return URLsOmitted, fmt.Errorf("unknown LOG_URLS '%s', use true, hash or false", s)
+	}
+}
+
+// SetURLMode sets what is logged of the sites that are visited to URLsShown, URLsHashed or URLsOmitted,
+// instead of LOG_URLS. It returns the previous mode.
+func SetURLMode(mode string) string {
+	previous := urlMode
+	urlMode = mode
+	return previous
+}
+
+// Private returns an attribute for a value that reveals which sites are visited, like a URL,
+// a host or the domains of a rule. Depending on LOG_URLS, the value is logged, hashed or left out.
+func Private(key string, value string) slog.Attr {
+	switch {
+	case value == "":
+		return slog.Attr{}
+	case urlMode == URLsHashed:
+		sum := sha256.Sum256([]byte(value))
+		return slog.String(key, hex.EncodeToString(sum[:6]))
+	case urlMode == URLsOmitted:
+		return slog.Attr{}
+	default:
+		return slog.String(key, value)
+	}
+}
+
+// Err returns the attribute for an error. Errors are always logged under the error key.
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
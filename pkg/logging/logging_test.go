@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]slog.Level{"": slog.LevelInfo, "debug": slog.LevelDebug, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		level, err := ParseLevel(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, level, s)
+	}
+
+	_, err := ParseLevel("verbose")
+	assert.EqualError(t, err, "unknown log level 'verbose', use debug, info, warn or error")
+}
+
+func TestNewHandler(t *testing.T) {
+	var b bytes.Buffer
+	handler, err := NewHandler(&b, "json", slog.LevelWarn)
+	assert.NoError(t, err)
+
+	logger := slog.New(handler)
+	logger.Info("hidden")
+	logger.Warn("shown", "status", 502, Err(errors.New("timeout")))
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &record))
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, 502.0, record["status"])
+	assert.Equal(t, "timeout", record["error"])
+
+	b.Reset()
+	handler, err = NewHandler(&b, "xml", slog.LevelInfo)
+	assert.Error(t, err)
+	slog.New(handler).Info("text", "host", "example.com")
+	assert.Contains(t, b.String(), "msg=text host=example.com")
+}
+
+func TestWithLevel(t *testing.T) {
+	var b bytes.Buffer
+	handler, _ := NewHandler(&b, "text", slog.LevelInfo)
+
+	logger := slog.New(WithLevel(handler, slog.LevelWarn)).With("rule", "example.com")
+	logger.Info("hidden")
+	logger.Warn("shown")
+	assert.NotContains(t, b.String(), "hidden")
+	assert.Contains(t, b.String(), "msg=shown rule=example.com")
+}
+
+func TestPrivate(t *testing.T) {
+	defer func(mode string) { urlMode = mode }(urlMode)
+
+	urlMode = URLsShown
+	assert.Equal(t, slog.String("url", "https://example.com/"), Private("url", "https://example.com/"))
+
+	urlMode = URLsHashed
+	hashed := Private("url", "https://example.com/")
+	assert.Equal(t, "url", hashed.Key)
+	assert.Len(t, hashed.Value.String(), 12)
+	assert.NotContains(t, hashed.Value.String(), "example")
+	assert.Equal(t, hashed, Private("url", "https://example.com/"))
+	assert.NotEqual(t, hashed, Private("url", "https://example.org/"))
+
+	urlMode = URLsOmitted
+	assert.True(t, Private("url", "https://example.com/").Equal(slog.Attr{}))
+
+	mode, err := parseURLMode("HASH")
+	assert.NoError(t, err)
+	assert.Equal(t, URLsHashed, mode)
+	mode, err = parseURLMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, URLsOmitted, mode)
+	mode, err = parseURLMode("yes")
+	assert.Error(t, err)
+	assert.Equal(t, URLsOmitted, mode)
+}
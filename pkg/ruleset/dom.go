@@ -0,0 +1,151 @@
+package ruleset
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"gopkg.in/yaml.v3"
+)
+
+// DOMOperation modifies the elements matched by Selector on the server, so that it also works
+// for clients without JavaScript. An operation may combine several modifications, they are
+// applied in the order of the fields.
+type DOMOperation struct {
+	Selector string `yaml:"selector"`
+	// RenameAttr renames attributes, e.g. data-src to src
+	RenameAttr map[string]string `yaml:"renameAttr,omitempty"`
+	// RemoveAttr removes attributes
+	RemoveAttr []string `yaml:"removeAttr,omitempty"`
+	// SetAttr sets attributes to a value
+	SetAttr map[string]string `yaml:"setAttr,omitempty"`
+	// RemoveClass removes classes from the class attribute
+	RemoveClass []string `yaml:"removeClass,omitempty"`
+	// Unhide shows hidden elements: it removes the hidden attribute and display:none from their style
+	Unhide bool `yaml:"unhide,omitempty"`
+	// SetText replaces the content of the elements with text
+	SetText *string `yaml:"setText,omitempty"`
+	// MoveTo moves the elements to the end of the first element matched by this selector
+	MoveTo string `yaml:"moveTo,omitempty"`
+	// Unwrap replaces the elements with their children
+	Unwrap bool `yaml:"unwrap,omitempty"`
+	// Remove removes the elements
+	Remove bool `yaml:"remove,omitempty"`
+}
+
+// UnmarshalYAML decodes a DOM operation and checks its selectors.
+func (op *DOMOperation) UnmarshalYAML(value *yaml.Node) error {
+	type plain DOMOperation
+	var p problems
+	if err := p.decode(value, (*plain)(op), "ruleset.DOMOperation"); err != nil {
+		return err
+	}
+
+	if op.Selector == "" {
+		p.add(value, "dom operation without selector")
+	}
+	p.checkSelector(value, "selector", op.Selector)
+	p.checkSelector(value, "moveTo", op.MoveTo)
+
+	if len(op.RenameAttr) == 0 && len(op.RemoveAttr) == 0 && len(op.SetAttr) == 0 && len(op.RemoveClass) == 0 &&
+		!op.Unhide && op.SetText == nil && op.MoveTo == "" && !op.Unwrap && !op.Remove {
+		p.add(value, "dom operation for '%s' does nothing", op.Selector)
+	}
+
+	return p.err()
+}
+
+// Apply modifies the elements of doc matched by the operation's selector.
+func (op DOMOperation) Apply(doc *goquery.Document) {
+	sel := doc.Find(op.Selector)
+	if sel.Length() == 0 {
+		return
+	}
+
+	// attributes are renamed and set in sorted order, so that operations on the same attribute have the same result every time
+	for _, from := range sortedKeys(op.RenameAttr) {
+		to := op.RenameAttr[from]
+		sel.Each(func(_ int, s *goquery.Selection) {
+			if value, ok := s.Attr(from); ok {
+				s.RemoveAttr(from)
+				s.SetAttr(to, value)
+			}
+		})
+	}
+
+	for _, attr := range op.RemoveAttr {
+		sel.RemoveAttr(attr)
+	}
+
+	for _, attr := range sortedKeys(op.SetAttr) {
+		sel.SetAttr(attr, op.SetAttr[attr])
+	}
+
+	if len(op.RemoveClass) > 0 {
+		sel.RemoveClass(op.RemoveClass...)
+	}
+
+	if op.Unhide {
+		sel.RemoveAttr("hidden")
+		sel.Each(func(_ int, s *goquery.Selection) {
+			if style, ok := s.Attr("style"); ok {
+				s.SetAttr("style", removeDisplayNone(style))
+			}
+		})
+	}
+
+	if op.SetText != nil {
+		sel.SetText(*op.SetText)
+	}
+
+	if op.MoveTo != "" {
+		if target := doc.Find(op.MoveTo).First(); target.Length() > 0 {
+			target.AppendSelection(sel)
+		}
+	}
+
+	if op.Unwrap {
+		sel.Each(func(_ int, s *goquery.Selection) {
+			s.ReplaceWithSelection(s.Contents())
+		})
+	}
+
+	if op.Remove {
+		sel.Remove()
+	}
+}
+
+// WrittenAttrs returns the attributes that the operation renames attributes to or sets.
+func (op DOMOperation) WrittenAttrs() []string {
+	var attrs []string
+	for _, from := range sortedKeys(op.RenameAttr) {
+		attrs = append(attrs, op.RenameAttr[from])
+	}
+	return append(attrs, sortedKeys(op.SetAttr)...)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// removeDisplayNone removes display:none declarations from an inline style.
+func removeDisplayNone(style string) string {
+	var kept []string
+	for _, decl := range strings.Split(style, ";") {
+		name, value, _ := strings.Cut(decl, ":")
+		value = strings.ToLower(strings.Join(strings.Fields(value), ""))
+		if strings.EqualFold(strings.TrimSpace(name), "display") && strings.HasPrefix(value, "none") {
+			continue
+		}
+		if strings.TrimSpace(decl) != "" {
+			kept = append(kept, strings.TrimSpace(decl))
+		}
+	}
+	return strings.Join(kept, "; ")
+}
@@ -0,0 +1,93 @@
+package ruleset
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDOMOperationApply(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><body>
+<div class="overlay">Subscribe</div>
+<article class="article locked"><div class="wrapper"><p style="color: red; display: none">Story</p></div>
+<img data-src="a.png" loading="lazy"><p hidden>More</p></article>
+<h1>Title</h1><aside>Related</aside>
+</body></html>`))
+	assert.NoError(t, err)
+
+	empty := ""
+	ops := []DOMOperation{
+		{Selector: ".overlay", Remove: true},
+		{Selector: ".wrapper", Unwrap: true},
+		{Selector: "img", RenameAttr: map[string]string{"data-src": "src"}, RemoveAttr: []string{"loading"}, SetAttr: map[string]string{"alt": "image"}},
+		{Selector: "article", RemoveClass: []string{"locked"}},
+		{Selector: "article p", Unhide: true},
+		{Selector: "h1", SetText: &empty},
+		{Selector: "aside", MoveTo: "article"},
+	}
+	for _, op := range ops {
+		op.Apply(doc)
+	}
+
+	assert.Equal(t, 0, doc.Find(".overlay").Length())
+	assert.Equal(t, 0, doc.Find(".wrapper").Length())
+	assert.Equal(t, "Story", doc.Find("article > p").First().Text())
+	assert.Equal(t, "color: red", doc.Find("article > p").First().AttrOr("style", ""))
+	assert.False(t, doc.Find("article > p").Last().Is("[hidden]"))
+
+	img := doc.Find("img")
+	assert.Equal(t, "a.png", img.AttrOr("src", ""))
+	assert.False(t, img.Is("[data-src], [loading]"))
+	assert.Equal(t, "image", img.AttrOr("alt", ""))
+
+	assert.Equal(t, "article", doc.Find("article").AttrOr("class", ""))
+	assert.Equal(t, "", doc.Find("h1").Text())
+	assert.Equal(t, 1, doc.Find("article > aside:last-child").Length())
+}
+
+func TestDOMOperationApplyOrder(t *testing.T) {
+	op := DOMOperation{
+		Selector:   "img",
+		RenameAttr: map[string]string{"data-src": "data-lazy", "data-lazy": "src", "data-a": "data-b"},
+		SetAttr:    map[string]string{"data-b": "set", "src": "placeholder.png"},
+	}
+
+	// renames and sets are applied in sorted order, whatever the order of the maps
+	for i := 0; i < 20; i++ {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<img data-src="a.png" data-a="b">`))
+		assert.NoError(t, err)
+		op.Apply(doc)
+
+		img := doc.Find("img")
+		assert.Equal(t, "placeholder.png", img.AttrOr("src", ""))
+		assert.Equal(t, "set", img.AttrOr("data-b", ""))
+		assert.Equal(t, "a.png", img.AttrOr("data-lazy", ""))
+		assert.False(t, img.Is("[data-src], [data-a]"))
+	}
+
+	assert.Equal(t, []string{"data-b", "src", "data-lazy", "data-b", "src"}, op.WrittenAttrs())
+}
+
+func TestDOMOperationSchema(t *testing.T) {
+	_, err := ParseRules([]byte(`
+- domain: example.com
+  dom:
+    - selector: .paywall
+      remove: true
+    - selector: "div["
+      remove: true
+    - selector: article
+      moveTo: "main["
+    - selector: article
+    - remove: true`), "dom.yaml")
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "dom.yaml:6: invalid selector in selector")
+		assert.Contains(t, err.Error(), "dom.yaml:9: invalid selector in moveTo")
+		assert.Contains(t, err.Error(), "dom.yaml:10: dom operation for 'article' does nothing")
+		assert.Contains(t, err.Error(), "dom.yaml:11: dom operation without selector")
+		assert.NotContains(t, err.Error(), "dom.yaml:4")
+	}
+}
@@ -0,0 +1,97 @@
+package ruleset
+
+import (
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Headers are the well known request headers of a rule, and the Content-Security-Policy of the response.
+// A value of "none" removes the header. Other headers are modified with requestHeaders and responseHeaders.
+type Headers struct {
+	UserAgent     string `yaml:"user-agent,omitempty"`
+	XForwardedFor string `yaml:"x-forwarded-for,omitempty"`
+	Referer       string `yaml:"referer,omitempty"`
+	Cookie        string `yaml:"cookie,omitempty"`
+	CSP           string `yaml:"content-security-policy,omitempty"`
+}
+
+// UnmarshalYAML decodes the headers block and rejects unknown keys,
+// which would otherwise be ignored without notice.
+func (h *Headers) UnmarshalYAML(value *yaml.Node) error {
+	type plain Headers
+	var p problems
+	if err := p.decodeLoose(value, (*plain)(h)); err != nil {
+		return err
+	}
+
+	for _, key := range unknownKeys(value, (*plain)(h)) {
+		p.add(key, "unknown header '%s' in headers, use requestHeaders or responseHeaders for other headers", key.Value)
+	}
+
+	return p.err()
+}
+
+// HeaderOps modifies a set of HTTP headers.
+type HeaderOps struct {
+	// Set replaces the values of a header. A value of "none" removes the header.
+	Set map[string]string `yaml:"set,omitempty"`
+	// Add appends a value to a header.
+	Add map[string]string `yaml:"add,omitempty"`
+	// Delete removes headers.
+	Delete []string `yaml:"delete,omitempty"`
+}
+
+// Apply modifies h by deleting, then setting, then adding headers.
+func (ops HeaderOps) Apply(h http.Header) {
+	for _, key := range ops.Delete {
+		h.Del(key)
+	}
+
+	for key, value := range ops.Set {
+		if value == "none" {
+			h.Del(key)
+			continue
+		}
+		h.Set(key, value)
+	}
+
+	for key, value := range ops.Add {
+		h.Add(key, value)
+	}
+}
+
+// canonical returns ops with canonical header names, e.g. X-Frame-Options for x-frame-options.
+// If a map holds the same header in different spellings, the value of the last spelling in sort order is kept.
+func (ops HeaderOps) canonical() HeaderOps {
+	canonicalMap := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		c := make(map[string]string, len(m))
+		for _, key := range sortedKeys(m) {
+			c[http.CanonicalHeaderKey(key)] = m[key]
+		}
+		return c
+	}
+
+	c := HeaderOps{Set: canonicalMap(ops.Set), Add: canonicalMap(ops.Add)}
+	for _, key := range ops.Delete {
+		c.Delete = append(c.Delete, http.CanonicalHeaderKey(key))
+	}
+	return c
+}
+
+// Modified returns the headers that Apply sets or adds.
+func (ops HeaderOps) Modified() []string {
+	var keys []string
+	for key, value := range ops.Set {
+		if value != "none" {
+			keys = append(keys, key)
+		}
+	}
+	for key := range ops.Add {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,53 @@
+package ruleset
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadersUnknownKey(t *testing.T) {
+	_, err := loadRuleFromString(`
+- domain: example.com
+  headers:
+    referer: https://www.google.com/
+    ueser-agent: Googlebot`)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ".yaml:5: unknown header 'ueser-agent'")
+	}
+
+	rs, err := loadRuleFromString(`
+- domain: example.com
+  headers:
+    user-agent: Googlebot
+  requestHeaders:
+    set:
+      Authorization: Bearer token`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Googlebot", rs[0].Headers.UserAgent)
+	assert.Equal(t, "Bearer token", rs[0].RequestHeaders.Set["Authorization"])
+}
+
+func TestHeaderOpsApply(t *testing.T) {
+	h := http.Header{
+		"X-Frame-Options": {"DENY"},
+		"Referer":         {"https://example.com/"},
+		"Accept-Language": {"de"},
+	}
+
+	ops := HeaderOps{
+		Set:    map[string]string{"Referer": "none", "Authorization": "Bearer token"},
+		Add:    map[string]string{"Accept-Language": "en"},
+		Delete: []string{"x-frame-options"},
+	}
+	ops.Apply(h)
+
+	assert.Equal(t, http.Header{
+		"Authorization":   {"Bearer token"},
+		"Accept-Language": {"de", "en"},
+	}, h)
+	assert.ElementsMatch(t, []string{"Authorization", "Accept-Language"}, ops.Modified())
+}
@@ -0,0 +1,339 @@
+package ruleset
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Matcher finds the rule for a URL. It indexes the domains of a RuleSet in a trie of their labels,
+// from the top level domain down, so that a lookup takes time proportional to the number of labels
+// in the host, however many rules there are. A Matcher is safe for concurrent use.
+type Matcher struct {
+	rules   RuleSet
+	entries []matcherEntry
+	root    *domainNode
+	// global are the indexes of the rules for GlobalDomain
+	global []int
+}
+
+// matcherEntry holds the compiled path patterns of a rule.
+type matcherEntry struct {
+	paths    []pathPattern
+	excludes []pathPattern
+	hasPaths bool
+	// extends are the templates of the rule, which are merged into the compiled rule
+	extends Names
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	// rules are the indexes of the rules for the domain, in ruleset order
+	rules []int
+}
+
+// NewMatcher compiles rs into a Matcher. The rules of the Matcher are copies of rs with their templates
+// resolved and their regexes compiled. Rules with unresolvable templates are used as they are, the problem
+// is reported when the ruleset is loaded.
+func NewMatcher(rs RuleSet) *Matcher {
+	extends := make([]Names, len(rs))
+	for i, rule := range rs {
+		extends[i] = rule.Extends
+	}
+	rs, _ = rs.Resolved()
+
+	m := &Matcher{
+		rules:   make(RuleSet, len(rs)),
+		entries: make([]matcherEntry, len(rs)),
+		root:    &domainNode{},
+	}
+
+	for i, rule := range rs {
+		m.rules[i] = rule.compiled()
+		m.entries[i] = matcherEntry{
+			paths:    compilePatterns(rule.Paths),
+			excludes: compilePatterns(rule.ExcludePaths),
+			hasPaths: len(rule.Paths) > 0,
+			extends:  extends[i],
+		}
+
+		for _, domain := range rule.allDomains() {
+			if domain == GlobalDomain {
+				m.global = append(m.global, i)
+				continue
+			}
+
+			domain = normalizeHost(domain)
+			if domain == "" {
+				continue
+			}
+
+			n := m.root
+			forEachLabel(domain, func(label string) bool {
+				child, ok := n.children[label]
+				if !ok {
+					if n.children == nil {
+						n.children = map[string]*domainNode{}
+					}
+					child = &domainNode{}
+					n.children[label] = child
+				}
+				n = child
+				return true
+			})
+
+			if len(n.rules) == 0 || n.rules[len(n.rules)-1] != i {
+				n.rules = append(n.rules, i)
+			}
+		}
+	}
+
+	return m
+}
+
+// Match returns the rule for host and path. A rule for a domain matches the domain and its subdomains,
+// e.g. a rule for nytimes.com matches www.nytimes.com but not notnytimes.com. If several rules match,
+// the one with the highest priority wins, then the one for the most specific domain, then the one with
+// the most specific path pattern, and then the first one in the ruleset. The port of host is ignored.
+//
+// The matching global rules are merged under the winning rule, in the same order, so that the more
+// specific rules override the more general ones.
+func (m *Matcher) Match(host string, path string) (Rule, bool) {
+	rule, _, ok := m.match(host, path, nil)
+	return rule, ok
+}
+
+// Explanation tells why Explain picked a rule.
+type Explanation struct {
+	// Rule names the winning rule, see Rule.Label. It is empty if only global rules matched.
+	Rule string `json:"rule,omitempty"`
+	// Domain is the domain of the winning rule that matched the host
+	Domain string `json:"domain,omitempty"`
+	// Path is the path pattern of the winning rule that matched, empty if the rule applies to every path
+	Path string `json:"path,omitempty"`
+	// Priority is the priority of the winning rule
+	Priority int `json:"priority"`
+	// Extends are the templates the winning rule is merged onto
+	Extends []string `json:"extends,omitempty"`
+	// Global are the global rules merged under the winning rule, in the order they are merged
+	Global []string `json:"global,omitempty"`
+	// Lost are the other rules that matched the host and path, but are less specific or have a lower priority
+	Lost []string `json:"lost,omitempty"`
+}
+
+// Explain is Match, and also tells why the rule was picked.
+func (m *Matcher) Explain(host string, path string) (Rule, Explanation, bool) {
+	var e Explanation
+	rule, _, ok := m.match(host, path, &e)
+	return rule, e, ok
+}
+
+// match implements Match and Explain. The explanation is only filled in if e is not nil.
+func (m *Matcher) match(host string, path string, e *Explanation) (Rule, *Explanation, bool) {
+	best, bestDepth, bestSpecificity, bestPattern := -1, 0, 0, ""
+	var matched []int
+
+	host = normalizeHost(host)
+	n := m.root
+	depth := 0
+	forEachLabel(host, func(label string) bool {
+		n = n.children[label]
+		if n == nil {
+			return false
+		}
+		depth++
+
+		for _, idx := range n.rules {
+			specificity, pattern, ok := m.entries[idx].match(path)
+			if !ok {
+				continue
+			}
+			if e != nil {
+				matched = append(matched, idx)
+			}
+			if best < 0 || m.better(idx, depth, specificity, best, bestDepth, bestSpecificity) {
+				best, bestDepth, bestSpecificity, bestPattern = idx, depth, specificity, pattern
+			}
+		}
+		return true
+	})
+
+	if e != nil && best >= 0 {
+		e.Rule = m.rules[best].Label()
+		e.Domain = lastLabels(host, bestDepth)
+		e.Path = bestPattern
+		e.Priority = m.rules[best].Priority
+		e.Extends = m.entries[best].extends
+		for _, idx := range matched {
+			if idx != best {
+				e.Lost = append(e.Lost, m.rules[idx].Label())
+			}
+		}
+	}
+
+	if len(m.global) == 0 {
+		if best < 0 {
+			return Rule{}, e, false
+		}
+		return m.rules[best], e, true
+	}
+
+	type candidate struct{ idx, specificity int }
+	var global []candidate
+	for _, idx := range m.global {
+		if specificity, _, ok := m.entries[idx].match(path); ok {
+			global = append(global, candidate{idx, specificity})
+		}
+	}
+	sort.SliceStable(global, func(i, j int) bool {
+		return m.better(global[j].idx, 0, global[j].specificity, global[i].idx, 0, global[i].specificity)
+	})
+
+	if best < 0 && len(global) == 0 {
+		return Rule{}, e, false
+	}
+
+	var rule Rule
+	for _, c := range global {
+		rule = Merge(rule, m.rules[c.idx])
+		if e != nil {
+			e.Global = append(e.Global, m.rules[c.idx].Label())
+		}
+	}
+	if best >= 0 {
+		rule = Merge(rule, m.rules[best])
+	}
+	return rule, e, true
+}
+
+// better reports whether rule a, found at domain depth depthA with path specificity specA,
+// wins over rule b.
+func (m *Matcher) better(a, depthA, specA, b, depthB, specB int) bool {
+	if pa, pb := m.rules[a].Priority, m.rules[b].Priority; pa != pb {
+		return pa > pb
+	}
+	if depthA != depthB {
+		return depthA > depthB
+	}
+	if specA != specB {
+		return specA > specB
+	}
+	return a < b
+}
+
+// match reports whether the rule applies to path, and which path pattern matched and how specific it is.
+// Rules without paths apply to every path, with the lowest specificity.
+func (e matcherEntry) match(path string) (int, string, bool) {
+	for _, p := range e.excludes {
+		if p.match(path) {
+			return 0, "", false
+		}
+	}
+
+	if !e.hasPaths {
+		return -1, "", true
+	}
+
+	specificity, pattern, ok := 0, "", false
+	for _, p := range e.paths {
+		if p.match(path) && (!ok || p.specificity > specificity) {
+			specificity, pattern, ok = p.specificity, p.pattern, true
+		}
+	}
+	return specificity, pattern, ok
+}
+
+// Rules returns the compiled rules of the Matcher. They must not be modified.
+func (m *Matcher) Rules() RuleSet {
+	return m.rules
+}
+
+// Label names the rule in reports: its domains, or its name if it has none.
+func (r Rule) Label() string {
+	if domains := r.allDomains(); len(domains) > 0 {
+		return strings.Join(domains, ", ")
+	}
+	return r.Name
+}
+
+// DomainOf returns the domain of the rule that host is, or is a subdomain of. The port of host is ignored.
+// It returns false if host belongs to none of them, which is the case for global rules.
+func (r Rule) DomainOf(host string) (string, bool) {
+	host = normalizeHost(host)
+	for _, domain := range r.allDomains() {
+		d := normalizeHost(domain)
+		if d == "" || domain == GlobalDomain {
+			continue
+		}
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// allDomains returns the domain and domains of the rule, without modifying either.
+func (r Rule) allDomains() []string {
+	domains := make([]string, 0, len(r.Domains)+1)
+	if r.Domain != "" {
+		domains = append(domains, r.Domain)
+	}
+	return append(domains, r.Domains...)
+}
+
+// compiled returns a copy of the rule with its regexes compiled. Invalid regexes are left for Regexp to report.
+func (r Rule) compiled() Rule {
+	r.RegexRules = compileRegexes(r.RegexRules)
+	r.URLMods.Domain = compileRegexes(r.URLMods.Domain)
+	r.URLMods.Path = compileRegexes(r.URLMods.Path)
+	return r
+}
+
+func compileRegexes(regexes []Regex) []Regex {
+	if len(regexes) == 0 {
+		return regexes
+	}
+
+	compiled := make([]Regex, len(regexes))
+	for i, r := range regexes {
+		if r.re == nil {
+			r.re, _ = regexp.Compile(r.Match)
+		}
+		compiled[i] = r
+	}
+	return compiled
+}
+
+// normalizeHost lower-cases host and removes its port and any trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// lastLabels returns the last n labels of domain, e.g. example.com for www.example.com and 2.
+func lastLabels(domain string, n int) string {
+	i := len(domain)
+	for ; n > 0 && i > 0; n-- {
+		i = strings.LastIndexByte(domain[:i], '.')
+	}
+	return domain[i+1:]
+}
+
+// forEachLabel calls fn for the labels of domain from the last one to the first one, until fn returns false.
+func forEachLabel(domain string, fn func(label string) bool) {
+	for domain != "" {
+		label := domain
+		i := strings.LastIndexByte(domain, '.')
+		if i >= 0 {
+			label = domain[i+1:]
+		}
+
+		if !fn(label) || i < 0 {
+			return
+		}
+		domain = domain[:i]
+	}
+}
@@ -0,0 +1,123 @@
+package ruleset
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	rs := RuleSet{
+		{Domain: "nytimes.com", Headers: Headers{Referer: "nytimes"}},
+		{Domains: []string{"www.example.com", "example.org"}, Paths: []string{"/news"}, Headers: Headers{Referer: "news"}},
+		{Domain: "example.com", Headers: Headers{Referer: "example"}},
+		{Domain: "cooking.nytimes.com", Headers: Headers{Referer: "cooking"}},
+	}
+	m := NewMatcher(rs)
+
+	testCases := []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"nytimes.com", "/", "nytimes"},
+		{"www.nytimes.com", "/", "nytimes"},
+		{"WWW.NYTimes.com.", "/", "nytimes"},
+		{"www.nytimes.com:443", "/", "nytimes"},
+		{"cooking.nytimes.com", "/", "cooking"},
+		{"notnytimes.com", "/", ""},
+		{"nytimes.com.evil.test", "/", ""},
+		{"www.example.com", "/news/today", "news"},
+		{"www.example.com", "/sports", "example"},
+		{"example.org", "/news", "news"},
+		{"example.org", "/sports", ""},
+		{"com", "/", ""},
+	}
+
+	for _, tc := range testCases {
+		rule, ok := m.Match(tc.host, tc.path)
+		assert.Equal(t, tc.expected != "", ok, tc.host+tc.path)
+		assert.Equal(t, tc.expected, rule.Headers.Referer, tc.host+tc.path)
+	}
+
+	// building the matcher leaves the ruleset as it was
+	assert.Equal(t, []string{"www.example.com", "example.org"}, rs[1].Domains)
+	assert.Len(t, m.Rules(), 4)
+}
+
+func TestMatcherCompilesRegexes(t *testing.T) {
+	rs := RuleSet{{Domain: "example.com", RegexRules: []Regex{{Match: "a+"}}}}
+	m := NewMatcher(rs)
+
+	rule, _ := m.Match("example.com", "/")
+	assert.NotNil(t, rule.RegexRules[0].re)
+	assert.Nil(t, rs[0].RegexRules[0].re)
+}
+
+func TestMatcherExplain(t *testing.T) {
+	m := NewMatcher(RuleSet{
+		{Domain: GlobalDomain, Headers: Headers{Cookie: "global=1"}},
+		{Name: "paywall", Headers: Headers{Referer: "template"}},
+		{Domain: "example.com", Extends: Names{"paywall"}},
+		{Domains: []string{"www.example.com", "example.org"}, Paths: Patterns{"/news/*"}, Priority: 1},
+	})
+
+	rule, e, ok := m.Explain("WWW.Example.com:443", "/news/today")
+	assert.True(t, ok)
+	assert.Equal(t, "global=1", rule.Headers.Cookie)
+	assert.Equal(t, Explanation{
+		Rule:     "www.example.com, example.org",
+		Domain:   "www.example.com",
+		Path:     "/news/*",
+		Priority: 1,
+		Global:   []string{GlobalDomain},
+		Lost:     []string{"example.com"},
+	}, e)
+
+	_, e, _ = m.Explain("blog.example.com", "/")
+	assert.Equal(t, "example.com", e.Domain)
+	assert.Equal(t, []string{"paywall"}, e.Extends)
+	assert.Empty(t, e.Path)
+
+	_, e, ok = m.Explain("other.test", "/")
+	assert.True(t, ok)
+	assert.Empty(t, e.Rule)
+	assert.Equal(t, []string{GlobalDomain}, e.Global)
+}
+
+// BenchmarkMatcher looks up hosts in a ruleset with thousands of rules.
+func BenchmarkMatcher(b *testing.B) {
+	rs := make(RuleSet, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		rs = append(rs, Rule{Domain: fmt.Sprintf("site%d.example%d.com", i, i%50)})
+	}
+	m := NewMatcher(rs)
+
+	hosts := []string{"www.site4999.example49.com", "site2500.example0.com", "unknown.example.org"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match(hosts[i%len(hosts)], "/article")
+	}
+}
+
+// BenchmarkLinearScan is the linear scan the Matcher replaces, for comparison.
+func BenchmarkLinearScan(b *testing.B) {
+	rs := make(RuleSet, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		rs = append(rs, Rule{Domain: fmt.Sprintf("site%d.example%d.com", i, i%50)})
+	}
+
+	hosts := []string{"www.site4999.example49.com", "site2500.example0.com", "unknown.example.org"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		host := hosts[i%len(hosts)]
+		for _, rule := range rs {
+			if host == rule.Domain || len(host) > len(rule.Domain) && host[len(host)-len(rule.Domain)-1:] == "."+rule.Domain {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GlobalDomain is the domain of rules that apply to every site.
+const GlobalDomain = "*"
+
+// Names is a list of names. In YAML, it is either a single name or a list of names.
+type Names []string
+
+// UnmarshalYAML decodes a single name or a list of names.
+func (n *Names) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*n = Names{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*n = list
+	return nil
+}
+
+// Resolved returns a copy of the ruleset in which every rule that extends templates is merged
+// onto them. A template is a rule with a name. Templates may extend other templates. Rules that
+// extend unknown templates, or templates that extend themselves, are returned as they are and
+// reported in the error.
+func (rs RuleSet) Resolved() (RuleSet, error) {
+	templates := map[string]int{}
+	var errs []error
+
+	for i, rule := range rs {
+		if rule.Name == "" {
+			continue
+		}
+		if _, ok := templates[rule.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate template name '%s'", rule.Name))
+			continue
+		}
+		templates[rule.Name] = i
+	}
+
+	resolved := make(RuleSet, len(rs))
+	for i, rule := range rs {
+		r, err := rs.resolve(rule, templates, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", ruleLabel(rule), err))
+			r = rule
+		}
+		resolved[i] = r
+	}
+
+	return resolved, errors.Join(errs...)
+}
+
+// resolve merges rule onto the templates it extends. chain holds the names of the templates being resolved.
+func (rs RuleSet) resolve(rule Rule, templates map[string]int, chain []string) (Rule, error) {
+	if len(rule.Extends) == 0 {
+		return rule, nil
+	}
+
+	var base Rule
+	for _, name := range rule.Extends {
+		for _, n := range chain {
+			if n == name {
+				return rule, fmt.Errorf("template '%s' extends itself through %s", name, strings.Join(chain, " -> "))
+			}
+		}
+
+		i, ok := templates[name]
+		if !ok {
+			return rule, fmt.Errorf("unknown template '%s'", name)
+		}
+
+		template, err := rs.resolve(rs[i], templates, append(chain, name))
+		if err != nil {
+			return rule, err
+		}
+		base = Merge(base, template)
+	}
+
+	merged := Merge(base, rule)
+	merged.Extends = nil
+	return merged, nil
+}
+
+// Merge returns rule applied on top of base. Values set in rule override the ones in base, this includes
+// single headers in headers, requestHeaders and responseHeaders. Lists of operations, like regexRules,
+// dom, injections and urlMods, are concatenated with the ones of base running first. The domains, paths,
+// priority and name of the result are the ones of rule, they are not inherited from base.
+func Merge(base Rule, rule Rule) Rule {
+	merged := rule
+
+	merged.Headers = mergeHeaders(base.Headers, rule.Headers)
+	merged.RequestHeaders = mergeHeaderOps(base.RequestHeaders, rule.RequestHeaders)
+	merged.ResponseHeaders = mergeHeaderOps(base.ResponseHeaders, rule.ResponseHeaders)
+
+	merged.GoogleCache = base.GoogleCache || rule.GoogleCache
+	merged.Strategies = override(base.Strategies, rule.Strategies)
+	if len(rule.Success.Status) == 0 && rule.Success.Selector == "" && rule.Success.MinLength == 0 {
+		merged.Success = base.Success
+	}
+	merged.Processors = override(base.Processors, rule.Processors)
+	merged.Proxy = overrideString(base.Proxy, rule.Proxy)
+	merged.Timeout = overrideString(base.Timeout, rule.Timeout)
+	merged.Cache.TTL = overrideString(base.Cache.TTL, rule.Cache.TTL)
+	if rule.Cache.Disabled == nil {
+		merged.Cache.Disabled = base.Cache.Disabled
+	}
+
+	merged.RegexRules = concat(base.RegexRules, rule.RegexRules)
+	merged.URLMods.Domain = concat(base.URLMods.Domain, rule.URLMods.Domain)
+	merged.URLMods.Path = concat(base.URLMods.Path, rule.URLMods.Path)
+	merged.URLMods.Query = concat(base.URLMods.Query, rule.URLMods.Query)
+	merged.DOM = concat(base.DOM, rule.DOM)
+	merged.Injections = concat(base.Injections, rule.Injections)
+
+	return merged
+}
+
+func mergeHeaders(base Headers, h Headers) Headers {
+	return Headers{
+		UserAgent:     overrideString(base.UserAgent, h.UserAgent),
+		XForwardedFor: overrideString(base.XForwardedFor, h.XForwardedFor),
+		Referer:       overrideString(base.Referer, h.Referer),
+		Cookie:        overrideString(base.Cookie, h.Cookie),
+		CSP:           overrideString(base.CSP, h.CSP),
+	}
+}
+
+// mergeHeaderOps merges ops onto base by canonical header name. Apply deletes before it sets, so a header
+// that ops deletes is also dropped from the headers base sets and adds, and a header that ops sets is
+// dropped from the ones base adds.
+func mergeHeaderOps(base HeaderOps, ops HeaderOps) HeaderOps {
+	base, ops = base.canonical(), ops.canonical()
+
+	set := withoutKeys(base.Set, ops.Delete)
+	add := withoutKeys(base.Add, ops.Delete)
+	for key := range ops.Set {
+		add = withoutKeys(add, []string{key})
+	}
+
+	return HeaderOps{
+		Set:    mergeMaps(set, ops.Set),
+		Add:    mergeMaps(add, ops.Add),
+		Delete: concat(base.Delete, ops.Delete),
+	}
+}
+
+// withoutKeys returns m without keys. m is copied if it contains any of them.
+func withoutKeys(m map[string]string, keys []string) map[string]string {
+	var copied map[string]string
+	for _, key := range keys {
+		if _, ok := m[key]; !ok {
+			continue
+		}
+		if copied == nil {
+			copied = make(map[string]string, len(m))
+			for k, v := range m {
+				copied[k] = v
+			}
+		}
+		delete(copied, key)
+	}
+
+	if copied == nil {
+		return m
+	}
+	return copied
+}
+
+func mergeMaps(base map[string]string, m map[string]string) map[string]string {
+	if len(base) == 0 {
+		return m
+	}
+	if len(m) == 0 {
+		return base
+	}
+
+	merged := make(map[string]string, len(base)+len(m))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range m {
+		merged[key] = value
+	}
+	return merged
+}
+
+func overrideString(base string, s string) string {
+	if s != "" {
+		return s
+	}
+	return base
+}
+
+func override[T any](base []T, list []T) []T {
+	if len(list) > 0 {
+		return list
+	}
+	return base
+}
+
+// concat returns base followed by list, without modifying either.
+func concat[T any](base []T, list []T) []T {
+	if len(base) == 0 {
+		return list
+	}
+	if len(list) == 0 {
+		return base
+	}
+
+	merged := make([]T, 0, len(base)+len(list))
+	merged = append(merged, base...)
+	return append(merged, list...)
+}
+
+// ruleLabel names a rule in error messages.
+func ruleLabel(rule Rule) string {
+	switch {
+	case rule.Name != "":
+		return fmt.Sprintf("'%s'", rule.Name)
+	case rule.Domain != "":
+		return fmt.Sprintf("for '%s'", rule.Domain)
+	case len(rule.Domains) > 0:
+		return fmt.Sprintf("for '%s'", rule.Domains[0])
+	default:
+		return "without domain"
+	}
+}
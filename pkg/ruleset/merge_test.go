@@ -0,0 +1,154 @@
+package ruleset
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	base := Rule{
+		Domain:         "*",
+		Headers:        Headers{UserAgent: "base", Referer: "https://www.google.com/"},
+		RequestHeaders: HeaderOps{Set: map[string]string{"A": "1", "B": "1"}, Delete: []string{"X"}},
+		RegexRules:     []Regex{{Match: "a", Replace: "b"}},
+		Injections:     []Injection{{Position: "head", Append: "<script>base</script>"}},
+		Proxy:          "socks5://127.0.0.1:9050",
+	}
+	rule := Rule{
+		Domain:         "example.com",
+		Headers:        Headers{UserAgent: "rule"},
+		RequestHeaders: HeaderOps{Set: map[string]string{"B": "2"}, Delete: []string{"Y"}},
+		RegexRules:     []Regex{{Match: "c", Replace: "d"}},
+		Injections:     []Injection{{Position: "body", Append: "<p>rule</p>"}},
+	}
+
+	merged := Merge(base, rule)
+
+	assert.Equal(t, "example.com", merged.Domain)
+	assert.Equal(t, Headers{UserAgent: "rule", Referer: "https://www.google.com/"}, merged.Headers)
+	assert.Equal(t, map[string]string{"A": "1", "B": "2"}, merged.RequestHeaders.Set)
+	assert.Equal(t, []string{"X", "Y"}, merged.RequestHeaders.Delete)
+	assert.Equal(t, []Regex{{Match: "a", Replace: "b"}, {Match: "c", Replace: "d"}}, merged.RegexRules)
+	assert.Equal(t, "<script>base</script>", merged.Injections[0].Append)
+	assert.Equal(t, "<p>rule</p>", merged.Injections[1].Append)
+	assert.Equal(t, "socks5://127.0.0.1:9050", merged.Proxy)
+
+	// merging does not modify the merged rules
+	assert.Len(t, base.RegexRules, 1)
+	assert.Equal(t, map[string]string{"A": "1", "B": "1"}, base.RequestHeaders.Set)
+}
+
+func TestMergeCacheDisabled(t *testing.T) {
+	disabled, enabled := true, false
+	base := Rule{Domain: "*"}
+	base.Cache.Disabled = &disabled
+
+	// a rule that does not set it keeps the cache disabled
+	merged := Merge(base, Rule{Domain: "example.com"})
+	assert.Equal(t, &disabled, merged.Cache.Disabled)
+
+	// a rule can enable it again
+	rule := Rule{Domain: "example.com"}
+	rule.Cache.Disabled = &enabled
+	merged = Merge(base, rule)
+	assert.Equal(t, &enabled, merged.Cache.Disabled)
+
+	merged = Merge(Rule{Domain: "*"}, Rule{Domain: "example.com"})
+	assert.Nil(t, merged.Cache.Disabled)
+}
+
+func TestMergeHeaderOps(t *testing.T) {
+	base := Rule{
+		Domain: "*",
+		ResponseHeaders: HeaderOps{
+			Set: map[string]string{"x-frame-options": "DENY", "X-Robots-Tag": "noindex"},
+			Add: map[string]string{"link": "<a>", "Vary": "Cookie"},
+		},
+	}
+	rule := Rule{
+		Domain: "example.com",
+		ResponseHeaders: HeaderOps{
+			Set:    map[string]string{"X-Frame-Options": "SAMEORIGIN", "vary": "Accept"},
+			Delete: []string{"x-robots-tag", "Link"},
+		},
+	}
+
+	merged := Merge(base, rule)
+
+	// header names are merged regardless of their spelling
+	assert.Equal(t, map[string]string{"X-Frame-Options": "SAMEORIGIN", "Vary": "Accept"}, merged.ResponseHeaders.Set)
+	assert.Empty(t, merged.ResponseHeaders.Add)
+	assert.Equal(t, []string{"X-Robots-Tag", "Link"}, merged.ResponseHeaders.Delete)
+
+	// the rule's delete removes the header that the global rule sets
+	h := http.Header{"X-Robots-Tag": {"all"}, "Vary": {"Origin"}}
+	merged.ResponseHeaders.Apply(h)
+	assert.Equal(t, http.Header{"X-Frame-Options": {"SAMEORIGIN"}, "Vary": {"Accept"}}, h)
+
+	// merging does not modify the merged rules
+	assert.Equal(t, map[string]string{"x-frame-options": "DENY", "X-Robots-Tag": "noindex"}, base.ResponseHeaders.Set)
+}
+
+func TestResolved(t *testing.T) {
+	rs, err := ParseRules([]byte(`
+- name: paywall
+  injections:
+    - position: head
+      append: <script>paywall</script>
+- name: google
+  extends: paywall
+  headers:
+    referer: https://www.google.com/
+- domains:
+    - www.example.com
+    - www.example.org
+  extends: [google]
+  injections:
+    - position: body
+      append: <p>site</p>`), "rules.yaml")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resolved, err := rs.Resolved()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.google.com/", resolved[2].Headers.Referer)
+	assert.Equal(t, []Injection{
+		{Position: "head", Append: "<script>paywall</script>"},
+		{Position: "body", Append: "<p>site</p>"},
+	}, resolved[2].Injections)
+	assert.Empty(t, resolved[2].Extends)
+
+	_, err = RuleSet{{Domain: "example.com", Extends: Names{"missing"}}}.Resolved()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown template 'missing'")
+	}
+
+	_, err = RuleSet{
+		{Name: "a", Extends: Names{"b"}},
+		{Name: "b", Extends: Names{"a"}},
+	}.Resolved()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "extends itself")
+	}
+}
+
+func TestMatcherGlobalRule(t *testing.T) {
+	m := NewMatcher(RuleSet{
+		{Domain: "*", Headers: Headers{Referer: "https://www.google.com/", Cookie: "global=1"}, Injections: []Injection{{Position: "head", Append: "global"}}},
+		{Domain: "*", Paths: Patterns{"/amp"}, Headers: Headers{Cookie: "amp=1"}},
+		{Domain: "example.com", Headers: Headers{Referer: "none"}, Injections: []Injection{{Position: "head", Append: "site"}}},
+	})
+
+	rule, ok := m.Match("www.example.com", "/amp/article")
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", rule.Domain)
+	assert.Equal(t, Headers{Referer: "none", Cookie: "amp=1"}, rule.Headers)
+	assert.Equal(t, []Injection{{Position: "head", Append: "global"}, {Position: "head", Append: "site"}}, rule.Injections)
+
+	rule, ok = m.Match("other.test", "/")
+	assert.True(t, ok)
+	assert.Equal(t, "global=1", rule.Headers.Cookie)
+}
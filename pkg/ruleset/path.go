@@ -0,0 +1,119 @@
+package ruleset
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Patterns are the path patterns of a rule. A pattern is
+//   - a regular expression if it starts with ~, e.g. ~^/\d{4}/\d{2}/
+//   - a glob if it contains * or ?, e.g. /section/*/article-*. It matches the whole path.
+//     Wildcards match within a path segment, except for ** which matches across segments.
+//   - a prefix otherwise, e.g. /news matches /news and /news/today
+type Patterns []string
+
+// UnmarshalYAML decodes a list of path patterns and checks their regexes.
+func (ps *Patterns) UnmarshalYAML(value *yaml.Node) error {
+	var list []string
+	var p problems
+	if err := p.decodeLoose(value, &list); err != nil {
+		return err
+	}
+	*ps = list
+
+	for i, pattern := range list {
+		if _, err := compilePattern(pattern); err != nil && i < len(value.Content) {
+			p.add(value.Content[i], "invalid path pattern '%s': %s", pattern, err)
+		}
+	}
+
+	return p.err()
+}
+
+// pathPattern is a compiled path pattern.
+type pathPattern struct {
+	// pattern is the pattern as written in the rule
+	pattern string
+	prefix  string
+	re      *regexp.Regexp
+	// specificity is the number of literal characters in the pattern. Patterns with more of them
+	// match fewer paths, and win over patterns with less of them.
+	specificity int
+}
+
+func compilePattern(pattern string) (pathPattern, error) {
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		expr := strings.TrimSpace(pattern[1:])
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return pathPattern{}, err
+		}
+		return pathPattern{re: re, specificity: literalCount(expr, `\.+*?()|[]{}^$`)}, nil
+
+	case strings.ContainsAny(pattern, "*?"):
+		re, err := regexp.Compile(globRegex(pattern))
+		if err != nil {
+			return pathPattern{}, err
+		}
+		return pathPattern{re: re, specificity: literalCount(pattern, "*?")}, nil
+
+	default:
+		return pathPattern{prefix: pattern, specificity: len(pattern)}, nil
+	}
+}
+
+func (p pathPattern) match(path string) bool {
+	if p.re != nil {
+		return p.re.MatchString(path)
+	}
+	return strings.HasPrefix(path, p.prefix)
+}
+
+// globRegex translates a glob to a regular expression that matches the whole path.
+func globRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String()
+}
+
+// literalCount returns the number of characters in s that are not in special.
+func literalCount(s string, special string) int {
+	n := 0
+	for _, r := range s {
+		if !strings.ContainsRune(special, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// compilePatterns compiles patterns, leaving out invalid ones.
+func compilePatterns(patterns []string) []pathPattern {
+	compiled := make([]pathPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		if p, err := compilePattern(pattern); err == nil {
+			p.pattern = pattern
+			compiled = append(compiled, p)
+		}
+	}
+	return compiled
+}
@@ -0,0 +1,92 @@
+package ruleset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPatterns(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/news", "/news/today", true},
+		{"/news", "/sports", false},
+		{"/section/*/article-*", "/section/world/article-123", true},
+		{"/section/*/article-*", "/section/world/europe/article-123", false},
+		{"/section/**/article-*", "/section/world/europe/article-123", true},
+		{"/page-?.html", "/page-1.html", true},
+		{"/page-?.html", "/page-10.html", false},
+		{`~^/\d{4}/\d{2}/`, "/2023/11/story.html", true},
+		{`~^/\d{4}/\d{2}/`, "/live/2023/11/", false},
+		{`~\.pdf$`, "/files/report.pdf", true},
+	}
+
+	for _, tc := range testCases {
+		p, err := compilePattern(tc.pattern)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.match, p.match(tc.path), tc.pattern+" "+tc.path)
+		}
+	}
+
+	_, err := compilePattern("~(")
+	assert.Error(t, err)
+}
+
+func TestParsePathPatterns(t *testing.T) {
+	_, err := ParseRules([]byte(`
+- domain: example.com
+  paths:
+    - /news
+    - ~(unclosed`), "rules.yaml")
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rules.yaml:5: invalid path pattern '~(unclosed'")
+	}
+}
+
+func TestMatcherSpecificity(t *testing.T) {
+	rs := RuleSet{
+		{Domain: "example.com", Headers: Headers{Referer: "domain"}},
+		{Domain: "example.com", Paths: Patterns{"/news"}, Headers: Headers{Referer: "news"}},
+		{Domain: "example.com", Paths: Patterns{"/news/*/live-*"}, Headers: Headers{Referer: "live"}},
+		{Domain: "example.com", Paths: Patterns{"/news"}, ExcludePaths: Patterns{"/news/archive/**"}, Headers: Headers{Referer: "later news"}},
+		{Domain: "www.example.com", Paths: Patterns{"/shop"}, Headers: Headers{Referer: "shop"}},
+		{Domain: "example.com", Paths: Patterns{"/shop"}, Priority: 10, Headers: Headers{Referer: "priority shop"}},
+		{Domain: "example.org", Paths: Patterns{"/"}, ExcludePaths: Patterns{`~\.pdf$`}, Headers: Headers{Referer: "org"}},
+	}
+	m := NewMatcher(rs)
+
+	testCases := []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"example.com", "/about", "domain"},
+		{"example.com", "/news/world", "news"},
+		{"example.com", "/news/world/live-123", "live"},
+		{"www.example.com", "/news/world", "news"},
+		{"www.example.com", "/shop/cart", "priority shop"},
+		{"example.org", "/index.html", "org"},
+		{"example.org", "/report.pdf", ""},
+	}
+
+	for _, tc := range testCases {
+		rule, _ := m.Match(tc.host, tc.path)
+		assert.Equal(t, tc.expected, rule.Headers.Referer, tc.host+tc.path)
+	}
+
+	// the order of the rules does not matter, except between equally specific ones
+	reversed := make(RuleSet, len(rs))
+	for i, rule := range rs {
+		reversed[len(rs)-1-i] = rule
+	}
+	m = NewMatcher(reversed)
+
+	rule, _ := m.Match("example.com", "/news/world/live-123")
+	assert.Equal(t, "live", rule.Headers.Referer)
+	rule, _ = m.Match("example.com", "/news/archive/2020/a")
+	assert.Equal(t, "news", rule.Headers.Referer)
+}
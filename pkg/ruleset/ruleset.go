@@ -1,16 +1,20 @@
 package ruleset
 
 import (
+	"bytes"
 	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,27 +22,81 @@ import (
 type Regex struct {
 	Match   string `yaml:"match"`
 	Replace string `yaml:"replace"`
+
+	// re is Match, compiled when the rule is loaded
+	re *regexp.Regexp
+}
+
+// Regexp returns the compiled Match expression.
+func (r Regex) Regexp() (*regexp.Regexp, error) {
+	if r.re != nil {
+		return r.re, nil
+	}
+	return regexp.Compile(r.Match)
 }
+
 type KV struct {
 	Key   string `yaml:"key"`
 	Value string `yaml:"value"`
 }
 
+// Strategy is one way of fetching a page. A rule tries its strategies in order until one succeeds.
+type Strategy struct {
+	Name string `yaml:"name,omitempty"`
+	// URL is a template for the URL to fetch instead of the page, e.g. a mirror like
+	// https://archive.org/wait/{url} or an AMP variant like {scheme}://{host}/amp{path}
+	URL       string  `yaml:"url,omitempty"`
+	UserAgent string  `yaml:"user-agent,omitempty"`
+	Referer   string  `yaml:"referer,omitempty"`
+	Success   Success `yaml:"success,omitempty"`
+}
+
+// Success is the condition a fetched page has to meet for a strategy to succeed.
+type Success struct {
+	Status    []int  `yaml:"status,omitempty"`
+	Selector  string `yaml:"selector,omitempty"`
+	MinLength int    `yaml:"minLength,omitempty"`
+}
+
 type RuleSet []Rule
 
 type Rule struct {
+	// Name makes the rule a template that other rules can extend. A rule with a name
+	// but without domains only applies through the rules that extend it.
+	Name string `yaml:"name,omitempty"`
+	// Extends are the templates the rule is merged onto, see Merge
+	Extends Names `yaml:"extends,omitempty"`
+	// Domain is the domain the rule applies to, including its subdomains. The rules for "*"
+	// apply to every site, merged under the rule for the site's domain.
 	Domain  string   `yaml:"domain,omitempty"`
 	Domains []string `yaml:"domains,omitempty"`
-	Paths   []string `yaml:"paths,omitempty"`
-	Headers struct {
-		UserAgent     string `yaml:"user-agent,omitempty"`
-		XForwardedFor string `yaml:"x-forwarded-for,omitempty"`
-		Referer       string `yaml:"referer,omitempty"`
-		Cookie        string `yaml:"cookie,omitempty"`
-		CSP           string `yaml:"content-security-policy,omitempty"`
-	} `yaml:"headers,omitempty"`
-	GoogleCache bool    `yaml:"googleCache,omitempty"`
-	RegexRules  []Regex `yaml:"regexRules,omitempty"`
+	// Paths limits the rule to paths that match one of the patterns
+	Paths Patterns `yaml:"paths,omitempty"`
+	// ExcludePaths excludes paths that match one of the patterns from the rule
+	ExcludePaths Patterns `yaml:"excludePaths,omitempty"`
+	// Priority orders rules that apply to the same URL. The rule with the highest priority wins,
+	// ties are won by the rule for the most specific domain, and then by the most specific path.
+	Priority int     `yaml:"priority,omitempty"`
+	Headers  Headers `yaml:"headers,omitempty"`
+	// RequestHeaders modifies the headers sent to the upstream server
+	RequestHeaders HeaderOps `yaml:"requestHeaders,omitempty"`
+	// ResponseHeaders modifies the headers of the upstream response. Headers it sets or adds
+	// are sent to the client regardless of FORWARD_HEADERS.
+	ResponseHeaders HeaderOps  `yaml:"responseHeaders,omitempty"`
+	GoogleCache     bool       `yaml:"googleCache,omitempty"`
+	Strategies      []Strategy `yaml:"strategies,omitempty"`
+	Success         Success    `yaml:"success,omitempty"`
+	RegexRules      []Regex    `yaml:"regexRules,omitempty"`
+	Processors      []string   `yaml:"processors,omitempty"`
+	Proxy           string     `yaml:"proxy,omitempty"`
+	Timeout         string     `yaml:"timeout,omitempty"`
+
+	Cache struct {
+		TTL string `yaml:"ttl,omitempty"`
+		// Disabled is nil if the rule does not set it, so that a rule can enable the cache again
+		// for a domain that a template or the global rule disabled it for
+		Disabled *bool `yaml:"disabled,omitempty"`
+	} `yaml:"cache,omitempty"`
 
 	URLMods struct {
 		Domain []Regex `yaml:"domain,omitempty"`
@@ -46,14 +104,44 @@ type Rule struct {
 		Query  []KV    `yaml:"query,omitempty"`
 	} `yaml:"urlMods,omitempty"`
 
-	Injections []struct {
-		Position string `yaml:"position,omitempty"`
-		Append   string `yaml:"append,omitempty"`
-		Prepend  string `yaml:"prepend,omitempty"`
-		Replace  string `yaml:"replace,omitempty"`
-	} `yaml:"injections,omitempty"`
+	// DOM modifies elements of HTML pages, before the injections are inserted
+	DOM []DOMOperation `yaml:"dom,omitempty"`
+
+	Injections []Injection `yaml:"injections,omitempty"`
+
+	// Tests check that the rule works on recorded pages, see ladder ruleset test
+	Tests []RuleTest `yaml:"tests,omitempty"`
+
+	// Source is the file or URL the rule was loaded from
+	Source string `yaml:"-"`
+}
+
+// RuleTest checks the page that ladder serves for URL, when the upstream server responds with Fixture.
+type RuleTest struct {
+	URL string `yaml:"url"`
+	// Fixture is the recorded upstream response, relative to the ruleset file. It is either a complete
+	// HTTP response with status line and headers, e.g. from curl -i, or just the HTML of the page.
+	Fixture string `yaml:"fixture"`
+	// Present are selectors that have to match an element of the page
+	Present []string `yaml:"present,omitempty"`
+	// Absent are selectors that must not match any element of the page
+	Absent []string `yaml:"absent,omitempty"`
+	// Contains are texts that the HTML of the page has to contain
+	Contains []string `yaml:"contains,omitempty"`
+}
+
+// Injection inserts HTML at the elements matched by the Position selector.
+type Injection struct {
+	Position string `yaml:"position,omitempty"`
+	Append   string `yaml:"append,omitempty"`
+	Prepend  string `yaml:"prepend,omitempty"`
+	Replace  string `yaml:"replace,omitempty"`
 }
 
+// remoteClient loads remote rulesets and their signatures. Its timeout keeps a server that stops
+// responding from holding up the reloads.
+var remoteClient = &http.Client{Timeout: 30 * time.Second}
+
 var remoteRegex = regexp.MustCompile(`^https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()!@:%_\+.~#?&\/\/=]*)`)
 
 // NewRulesetFromEnv creates a new RuleSet based on the RULESET environment variable.
@@ -62,13 +150,13 @@ var remoteRegex = regexp.MustCompile(`^https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]
 func NewRulesetFromEnv() RuleSet {
 	rulesPath, ok := os.LookupEnv("RULESET")
 	if !ok {
-		log.Printf("WARN: No ruleset specified. Set the `RULESET` environment variable to load one for a better success rate.")
+		slog.Warn("no ruleset specified. Set the `RULESET` environment variable to load one for a better success rate.")
 		return RuleSet{}
 	}
 
 	ruleSet, err := NewRuleset(rulesPath)
 	if err != nil {
-		log.Println(err)
+		slog.Error("failed to load ruleset", logging.Err(err))
 	}
 
 	return ruleSet
@@ -120,6 +208,10 @@ func NewRuleset(rulePaths string) (RuleSet, error) {
 		return ruleSet, errors.Join(errs...)
 	}
 
+	if _, err := ruleSet.Resolved(); err != nil {
+		return ruleSet, errors.Join(fmt.Errorf("WARN: failed to resolve ruleset templates"), err)
+	}
+
 	ruleSet.PrintStats()
 
 	return ruleSet, nil
@@ -137,26 +229,14 @@ func (rs *RuleSet) loadRulesFromLocalDir(path string) error {
 		return err
 	}
 
-	yamlRegex := regexp.MustCompile(`.*\.ya?ml`)
-
-	err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+	err = walkYaml(path, func(path string) error {
+		err := rs.loadRulesFromLocalFile(path)
 		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if isYaml := yamlRegex.MatchString(path); !isYaml {
-			return nil
-		}
-
-		err = rs.loadRulesFromLocalFile(path)
-		if err != nil {
-			log.Printf("WARN: failed to load directory ruleset '%s': %s, skipping", path, err)
+			slog.Warn("failed to load directory ruleset, skipping", "path", path, logging.Err(err))
 			return nil
 		}
 
-		log.Printf("INFO: loaded ruleset %s\n", path)
+		slog.Info("loaded ruleset", "path", path)
 
 		return nil
 	})
@@ -168,6 +248,25 @@ func (rs *RuleSet) loadRulesFromLocalDir(path string) error {
 	return nil
 }
 
+var yamlRegex = regexp.MustCompile(`.*\.ya?ml`)
+
+// walkYaml calls fn for every YAML file in the directory tree rooted at path, or for path itself if it is a file.
+func walkYaml(path string, fn func(path string) error) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if isYaml := yamlRegex.MatchString(path); !isYaml {
+			return nil
+		}
+
+		return fn(path)
+	})
+}
+
 // loadRulesFromLocalFile loads rules from a local YAML file specified by the path.
 // Returns an error if the file cannot be read or if there's a syntax error in the YAML.
 func (rs *RuleSet) loadRulesFromLocalFile(path string) error {
@@ -177,16 +276,16 @@ func (rs *RuleSet) loadRulesFromLocalFile(path string) error {
 		return errors.Join(e, err)
 	}
 
-	var r RuleSet
-	err = yaml.Unmarshal(yamlFile, &r)
+	r, err := ParseRules(yamlFile, path)
+	for i := range r {
+		r[i].Source = path
+	}
 
 	if err != nil {
-		e := fmt.Errorf("failed to load rules from local file, possible syntax error in '%s'", path)
+		e := fmt.Errorf("failed to load rules from local file, invalid rules in '%s'", path)
 		ee := errors.Join(e, err)
 
-		if _, ok := os.LookupEnv("DEBUG"); ok {
-			debugPrintRule(string(yamlFile), ee)
-		}
+		slog.Debug("invalid ruleset", "path", path, logging.Err(ee), "yaml", string(yamlFile))
 
 		return ee
 	}
@@ -200,47 +299,104 @@ func (rs *RuleSet) loadRulesFromLocalFile(path string) error {
 // It supports plain and gzip compressed content.
 // Returns an error if there's an issue accessing the URL or if there's a syntax error in the YAML.
 func (rs *RuleSet) loadRulesFromRemoteFile(rulesURL string) error {
-	var r RuleSet
+	remote, _, err := fetchRemoteRules(rulesURL, nil)
+	if err != nil {
+		return err
+	}
 
-	resp, err := http.Get(rulesURL)
+	*rs = append(*rs, remote.rules...)
+
+	return nil
+}
+
+// remoteRules are the rules loaded from a remote URL, and the validators to request them again with.
+type remoteRules struct {
+	rules        RuleSet
+	etag         string
+	lastModified string
+}
+
+// fetchRemoteRules loads rules from a remote URL. If prev is set, the request is conditional,
+// and prev is returned and changed is false if the rules have not been modified since.
+func fetchRemoteRules(rulesURL string, prev *remoteRules) (remote *remoteRules, changed bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, rulesURL, nil)
 	if err != nil {
 		e := fmt.Errorf("failed to load rules from remote url '%s'", rulesURL)
-		return errors.Join(e, err)
+		return nil, false, errors.Join(e, err)
+	}
+
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		e := fmt.Errorf("failed to load rules from remote url '%s'", rulesURL)
+		return nil, false, errors.Join(e, err)
 	}
 
 	defer resp.Body.Close()
 
+	if prev != nil && resp.StatusCode == http.StatusNotModified {
+		return prev, false, nil
+	}
+
 	if resp.StatusCode >= 400 {
 		e := fmt.Errorf("failed to load rules from remote url (%s) on '%s'", resp.Status, rulesURL)
-		return errors.Join(e, err)
+		return nil, false, e
 	}
 
-	var reader io.Reader
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		e := fmt.Errorf("failed to read rules from remote url '%s'", rulesURL)
+		return nil, false, errors.Join(e, err)
+	}
+
+	// the signature is made over the file as it is served, compressed or not
+	if err := verifyRemoteRules(rulesURL, data); err != nil {
+		return nil, false, err
+	}
 
 	isGzip := strings.HasSuffix(rulesURL, ".gz") || strings.HasSuffix(rulesURL, ".gzip") || resp.Header.Get("content-encoding") == "gzip"
 
 	if isGzip {
-		reader, err = gzip.NewReader(resp.Body)
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create gzip reader for URL '%s' with status code '%s': %w", rulesURL, resp.Status, err)
+		}
 
+		data, err = io.ReadAll(reader)
 		if err != nil {
-			return fmt.Errorf("failed to create gzip reader for URL '%s' with status code '%s': %w", rulesURL, resp.Status, err)
+			e := fmt.Errorf("failed to read rules from remote url '%s'", rulesURL)
+			return nil, false, errors.Join(e, err)
 		}
-	} else {
-		reader = resp.Body
 	}
 
-	err = yaml.NewDecoder(reader).Decode(&r)
+	r, err := ParseRules(data, rulesURL)
 
 	if err != nil {
-		e := fmt.Errorf("failed to load rules from remote url '%s' with status code '%s' and possible syntax error", rulesURL, resp.Status)
+		e := fmt.Errorf("failed to load rules from remote url '%s' with status code '%s', invalid rules", rulesURL, resp.Status)
 		ee := errors.Join(e, err)
 
-		return ee
+		return nil, false, ee
 	}
 
-	*rs = append(*rs, r...)
+	for i := range r {
+		r[i].Source = rulesURL
+	}
 
-	return nil
+	remote = &remoteRules{
+		rules:        r,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	return remote, true, nil
 }
 
 // ================= utility methods ==========================
@@ -297,14 +453,5 @@ func (rs *RuleSet) Count() int {
 
 // PrintStats logs the number of rules and domains loaded in the RuleSet.
 func (rs *RuleSet) PrintStats() {
-	log.Printf("INFO: Loaded %d rules for %d domains\n", rs.Count(), rs.DomainCount())
-}
-
-// debugPrintRule is a utility function for printing a rule and associated error for debugging purposes.
-func debugPrintRule(rule string, err error) {
-	fmt.Println("------------------------------ BEGIN DEBUG RULESET -----------------------------")
-	fmt.Printf("%s\n", err.Error())
-	fmt.Println("--------------------------------------------------------------------------------")
-	fmt.Println(rule)
-	fmt.Println("------------------------------ END DEBUG RULESET -------------------------------")
+	slog.Info("loaded rules", "rules", rs.Count(), "domains", rs.DomainCount())
 }
@@ -0,0 +1,240 @@
+package ruleset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaError is a problem in a ruleset, reported with the source and line it was found at.
+type SchemaError struct {
+	Source  string
+	Line    int
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Source, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Source, e.Line, e.Message)
+}
+
+var lineRegex = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// ParseRules decodes the YAML ruleset in data strictly. Unknown keys, values of the wrong type,
+// invalid regexes and invalid selectors are errors. Every problem is reported as a *SchemaError
+// with the name of the source and the line, so that a ruleset can be fixed in one go.
+func ParseRules(data []byte, source string) (RuleSet, error) {
+	var rs RuleSet
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(&rs)
+	if err == nil || errors.Is(err, io.EOF) {
+		return rs, nil
+	}
+
+	var messages []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	errs := make([]error, 0, len(messages))
+	for _, msg := range messages {
+		e := &SchemaError{Source: source, Message: msg}
+		if m := lineRegex.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Message = m[2]
+		}
+		errs = append(errs, e)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// problems collects the errors found while decoding a node. They are returned as a *yaml.TypeError,
+// which makes yaml.v3 carry on with the rest of the document instead of stopping at the first error.
+type problems []string
+
+func (p *problems) add(node *yaml.Node, format string, a ...interface{}) {
+	*p = append(*p, fmt.Sprintf("line %d: ", node.Line)+fmt.Sprintf(format, a...))
+}
+
+// decode decodes node into v and records its errors. Unlike a yaml.Decoder with KnownFields set,
+// node.Decode ignores unknown keys, so these are reported as errors in the type typeName.
+func (p *problems) decode(node *yaml.Node, v interface{}, typeName string) error {
+	if err := p.decodeLoose(node, v); err != nil {
+		return err
+	}
+
+	for _, key := range unknownKeys(node, v) {
+		p.add(key, "field %s not found in type %s", key.Value, typeName)
+	}
+
+	return nil
+}
+
+// decodeLoose decodes node into v and records its errors, ignoring unknown keys.
+func (p *problems) decodeLoose(node *yaml.Node, v interface{}) error {
+	err := node.Decode(v)
+
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		*p = append(*p, typeErr.Errors...)
+		return nil
+	}
+	return err
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &yaml.TypeError{Errors: p}
+}
+
+// unknownKeys returns the keys of the mapping node that no field of the struct v points to is tagged with.
+func unknownKeys(node *yaml.Node, v interface{}) []*yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		known[name] = true
+	}
+
+	var keys []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i]; !known[key.Value] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// valueNode returns the value of key in a mapping node, or the node itself if there is none.
+func valueNode(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return node
+}
+
+// checkSelector records an error if selector is not a valid CSS selector.
+func (p *problems) checkSelector(node *yaml.Node, key string, selector string) {
+	if selector == "" {
+		return
+	}
+	if _, err := cascadia.Compile(selector); err != nil {
+		p.add(valueNode(node, key), "invalid selector in %s: %s", key, err)
+	}
+}
+
+// UnmarshalYAML decodes a regex and compiles its match expression.
+func (r *Regex) UnmarshalYAML(value *yaml.Node) error {
+	type plain Regex
+	var p problems
+	if err := p.decode(value, (*plain)(r), "ruleset.Regex"); err != nil {
+		return err
+	}
+
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		p.add(valueNode(value, "match"), "invalid regex in match: %s", err)
+	}
+	r.re = re
+
+	return p.err()
+}
+
+// UnmarshalYAML decodes an injection and checks its position selector.
+func (i *Injection) UnmarshalYAML(value *yaml.Node) error {
+	type plain Injection
+	var p problems
+	if err := p.decode(value, (*plain)(i), "ruleset.Injection"); err != nil {
+		return err
+	}
+
+	p.checkSelector(value, "position", i.Position)
+
+	return p.err()
+}
+
+// UnmarshalYAML decodes a success condition and checks its selector.
+func (s *Success) UnmarshalYAML(value *yaml.Node) error {
+	type plain Success
+	var p problems
+	if err := p.decode(value, (*plain)(s), "ruleset.Success"); err != nil {
+		return err
+	}
+
+	p.checkSelector(value, "selector", s.Selector)
+
+	return p.err()
+}
+
+// UnmarshalYAML decodes a rule test and checks its selectors.
+func (t *RuleTest) UnmarshalYAML(value *yaml.Node) error {
+	type plain RuleTest
+	var p problems
+	if err := p.decode(value, (*plain)(t), "ruleset.RuleTest"); err != nil {
+		return err
+	}
+
+	if t.URL == "" || t.Fixture == "" {
+		p.add(value, "a test needs a url and a fixture")
+	}
+	for _, selector := range t.Present {
+		p.checkSelector(value, "present", selector)
+	}
+	for _, selector := range t.Absent {
+		p.checkSelector(value, "absent", selector)
+	}
+
+	return p.err()
+}
+
+// Validate loads the rulesets in rulePaths, separated by semicolons, like NewRuleset.
+// Unlike NewRuleset, it does not skip invalid files in directories but returns the problems of all of them.
+func Validate(rulePaths string) (RuleSet, error) {
+	var rs RuleSet
+	var errs []error
+
+	for _, rulePath := range strings.Split(rulePaths, ";") {
+		rulePath = strings.Trim(rulePath, " ")
+
+		if remoteRegex.MatchString(rulePath) {
+			errs = append(errs, rs.loadRulesFromRemoteFile(rulePath))
+			continue
+		}
+
+		err := walkYaml(rulePath, func(path string) error {
+			errs = append(errs, rs.loadRulesFromLocalFile(path))
+			return nil
+		})
+		errs = append(errs, err)
+	}
+
+	_, err := rs.Resolved()
+	errs = append(errs, err)
+
+	return rs, errors.Join(errs...)
+}
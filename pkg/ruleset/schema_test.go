@@ -0,0 +1,65 @@
+package ruleset
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRules(t *testing.T) {
+	rs, err := ParseRules([]byte(validYAML), "valid.yaml")
+	if assert.NoError(t, err) {
+		re, err := rs[0].RegexRules[0].Regexp()
+		assert.NoError(t, err)
+		assert.Equal(t, "^http:", re.String())
+	}
+
+	_, err = ParseRules([]byte(`
+- domain: example.com
+  domian: example.org
+  regexRules:
+    - match: "[incomplete"
+      replace: ""
+  injections:
+    - position: "div["
+      append: <p></p>
+  success:
+    selector: article
+    status: [ok]`), "rules.yaml")
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rules.yaml:3: field domian not found in type ruleset.Rule")
+		assert.Contains(t, err.Error(), "rules.yaml:5: invalid regex in match")
+		assert.Contains(t, err.Error(), "rules.yaml:8: invalid selector in position")
+		assert.Contains(t, err.Error(), "rules.yaml:12: cannot unmarshal !!str `ok` into int")
+	}
+
+	_, err = ParseRules([]byte("- domain: [\n"), "broken.yaml")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "broken.yaml:")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ruleset_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.WriteFile(filepath.Join(dir, "a.yaml"), []byte(validYAML), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("- domain: b.com\n  paths: /b\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "c.yaml"), []byte("- domain: c.com\n  regexRules:\n    - match: \"(\"\n"), 0o644)
+
+	_, err = Validate(dir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "b.yaml:2: cannot unmarshal !!str `/b` into []string")
+		assert.Contains(t, err.Error(), "c.yaml:3: invalid regex in match")
+	}
+
+	rs, err := Validate(filepath.Join(dir, "a.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rs.Count())
+}
@@ -0,0 +1,127 @@
+package ruleset
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/andesco/ladder/pkg/logging"
+)
+
+// SignatureSuffix is appended to the path of a remote ruleset to get the URL of its detached signature.
+const SignatureSuffix = ".sig"
+
+var (
+	// requireSignature makes remote rulesets load only with a valid signature by one of trustedKeys
+	requireSignature = strings.TrimSpace(os.Getenv("RULESET_PUBLIC_KEYS")) != ""
+	trustedKeys      = trustedKeysFromEnv()
+)
+
+// trustedKeysFromEnv parses the comma separated public keys in the RULESET_PUBLIC_KEYS environment variable.
+func trustedKeysFromEnv() []ed25519.PublicKey {
+	keys, err := ParsePublicKeys(os.Getenv("RULESET_PUBLIC_KEYS"))
+	if err != nil {
+		slog.Error("invalid RULESET_PUBLIC_KEYS, remote rulesets will be refused", logging.Err(err))
+	}
+	return keys
+}
+
+// ParsePublicKeys parses a comma separated list of base64 encoded ed25519 public keys.
+func ParsePublicKeys(s string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("'%s' is not a base64 encoded ed25519 public key", k)
+		}
+		keys = append(keys, ed25519.PublicKey(b))
+	}
+
+	return keys, nil
+}
+
+// GenerateKey creates a key pair to sign rulesets with. Both keys are base64 encoded.
+func GenerateKey() (publicKey string, privateKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(private.Seed()), nil
+}
+
+// Sign returns the base64 encoded signature of data, as it is served next to a ruleset.
+// privateKey is a key from GenerateKey.
+func Sign(data []byte, privateKey string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(b) != ed25519.SeedSize {
+		return "", errors.New("invalid private key, expected a base64 encoded ed25519 key from ladder ruleset keygen")
+	}
+
+	signature := ed25519.Sign(ed25519.NewKeyFromSeed(b), data)
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks that signature, as returned by Sign, is a signature of data by one of keys.
+func Verify(data []byte, signature string, keys []ed25519.PublicKey) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(b) != ed25519.SignatureSize {
+		return errors.New("malformed signature")
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, data, b) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match any trusted key")
+}
+
+// verifyRemoteRules checks the signature of the remote ruleset data, if trusted keys are configured.
+// The signature is loaded from the URL of the ruleset with SignatureSuffix appended to its path.
+func verifyRemoteRules(rulesURL string, data []byte) error {
+	if !requireSignature {
+		return nil
+	}
+
+	u, err := url.Parse(rulesURL)
+	if err != nil {
+		return err
+	}
+	u.Path += SignatureSuffix
+	u.RawPath = ""
+
+	resp, err := remoteClient.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("failed to load signature '%s': %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to load signature (%s) on '%s', unsigned rulesets are refused", resp.Status, u)
+	}
+
+	signature, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return fmt.Errorf("failed to load signature '%s': %w", u, err)
+	}
+
+	if err := Verify(data, string(signature), trustedKeys); err != nil {
+		return fmt.Errorf("refusing ruleset '%s': %w", rulesURL, err)
+	}
+
+	return nil
+}
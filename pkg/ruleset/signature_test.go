@@ -0,0 +1,92 @@
+package ruleset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	publicKey, privateKey, err := GenerateKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	keys, err := ParsePublicKeys(" " + publicKey + ",")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	data := []byte(validYAML)
+	signature, err := Sign(data, privateKey+"\n")
+	assert.NoError(t, err)
+
+	assert.NoError(t, Verify(data, signature+"\n", keys))
+	assert.Error(t, Verify([]byte(validYAML+"\n- domain: evil.test"), signature, keys))
+	assert.Error(t, Verify(data, "not a signature", keys))
+
+	otherKey, _, _ := GenerateKey()
+	otherKeys, _ := ParsePublicKeys(otherKey)
+	assert.Error(t, Verify(data, signature, otherKeys))
+
+	_, err = ParsePublicKeys("dG9vIHNob3J0")
+	assert.Error(t, err)
+}
+
+func TestLoadSignedRemoteRules(t *testing.T) {
+	publicKey, privateKey, _ := GenerateKey()
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(validYAML))
+	w.Close()
+
+	files := map[string][]byte{
+		"/signed.yaml":   []byte(validYAML),
+		"/signed.gz":     gz.Bytes(),
+		"/unsigned.yaml": []byte(validYAML),
+		"/tampered.yaml": []byte(validYAML + "\n- domain: evil.test"),
+	}
+	for _, name := range []string{"/signed.yaml", "/signed.gz"} {
+		signature, _ := Sign(files[name], privateKey)
+		files[name+SignatureSuffix] = []byte(signature)
+	}
+	files["/tampered.yaml"+SignatureSuffix] = files["/signed.yaml"+SignatureSuffix]
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	defer func(require bool, keys []ed25519.PublicKey) {
+		requireSignature, trustedKeys = require, keys
+	}(requireSignature, trustedKeys)
+	requireSignature = true
+	trustedKeys, _ = ParsePublicKeys(publicKey)
+
+	for _, name := range []string{"/signed.yaml", "/signed.gz"} {
+		var rs RuleSet
+		assert.NoError(t, rs.loadRulesFromRemoteFile(server.URL+name), name)
+		assert.Equal(t, "example.com", rs[0].Domain, name)
+	}
+
+	for _, name := range []string{"/unsigned.yaml", "/tampered.yaml"} {
+		var rs RuleSet
+		assert.Error(t, rs.loadRulesFromRemoteFile(server.URL+name), name)
+		assert.Empty(t, rs, name)
+	}
+
+	// without trusted keys, signatures are not checked
+	requireSignature = false
+	var rs RuleSet
+	assert.NoError(t, rs.loadRulesFromRemoteFile(server.URL+"/unsigned.yaml"))
+}
@@ -0,0 +1,253 @@
+package ruleset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andesco/ladder/pkg/logging"
+)
+
+// Watcher reloads rulesets when they change. Local files are checked for changes of their size and
+// modification time, remote rulesets are requested again with If-None-Match and If-Modified-Since.
+//
+// Every file and URL keeps its last good rules: if a changed file or URL fails to load, its previous
+// rules stay in place until it is fixed. The same goes for the whole ruleset if its templates cannot
+// be resolved.
+type Watcher struct {
+	// OnCheck is called by Run after every check with its error, which is nil if all changed rulesets
+	// loaded. See Pending for the rulesets that have never loaded.
+	OnCheck func(error)
+
+	paths    []string
+	onReload func(RuleSet)
+
+	files  map[string]*localRules
+	remote map[string]*remoteRules
+	loaded bool
+	// order are the files and URLs of the last check, in the order their rules are combined in
+	order []string
+	// applied are the files and URLs whose rules were passed to onReload at least once
+	applied map[string]bool
+}
+
+// localRules are the rules loaded from a local file, and the file's state when they were loaded.
+type localRules struct {
+	rules   RuleSet
+	loaded  bool
+	size    int64
+	modTime time.Time
+}
+
+// NewWatcher creates a Watcher for the rulesets in rulePaths, separated by semicolons.
+// onReload is called with the new ruleset whenever it changes.
+func NewWatcher(rulePaths string, onReload func(RuleSet)) *Watcher {
+	w := &Watcher{
+		onReload: onReload,
+		files:    map[string]*localRules{},
+		remote:   map[string]*remoteRules{},
+		applied:  map[string]bool{},
+	}
+
+	for _, rulePath := range strings.Split(rulePaths, ";") {
+		if rulePath = strings.Trim(rulePath, " "); rulePath != "" {
+			w.paths = append(w.paths, rulePath)
+		}
+	}
+
+	return w
+}
+
+// Check looks for changes of the local rulesets, and of the remote ones if remote is true.
+// On the first call, everything is loaded. Remote rulesets that have not loaded yet are
+// requested on every call. If anything changed, the ruleset is passed to onReload.
+// The returned error holds the rulesets that failed to load.
+func (w *Watcher) Check(remote bool) error {
+	changed := !w.loaded
+	var errs []error
+
+	seen := map[string]bool{}
+	w.order = w.order[:0]
+	for _, rulePath := range w.paths {
+		if remoteRegex.MatchString(rulePath) {
+			w.order = append(w.order, rulePath)
+			// remote rulesets that never loaded are retried on local checks too
+			if _, ok := w.remote[rulePath]; ok && !remote {
+				continue
+			}
+
+			next, modified, err := fetchRemoteRules(rulePath, w.remote[rulePath])
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			w.remote[rulePath] = next
+			changed = changed || modified
+			continue
+		}
+
+		err := walkYaml(rulePath, func(path string) error {
+			seen[path] = true
+			w.order = append(w.order, path)
+
+			modified, err := w.checkFile(path)
+			changed = changed || modified
+			errs = append(errs, err)
+			return nil
+		})
+		if err != nil {
+			// keep the rules of a directory that cannot be read
+			errs = append(errs, err)
+			kept := false
+			for path := range w.files {
+				if !seen[path] && strings.HasPrefix(path, rulePath) {
+					seen[path] = true
+					w.order = append(w.order, path)
+					kept = true
+				}
+			}
+			if !kept {
+				// without rules, so that Pending reports it
+				w.order = append(w.order, rulePath)
+			}
+		}
+	}
+
+	for path := range w.files {
+		if !seen[path] {
+			delete(w.files, path)
+			changed = true
+		}
+	}
+
+	w.loaded = true
+
+	if !changed {
+		return errors.Join(errs...)
+	}
+
+	rs := w.rules()
+	if _, err := rs.Resolved(); err != nil {
+		errs = append(errs, errors.Join(fmt.Errorf("failed to resolve ruleset templates, keeping the previous rules"), err))
+		return errors.Join(errs...)
+	}
+
+	w.onReload(rs)
+
+	for _, path := range w.order {
+		if local, ok := w.files[path]; ok && local.loaded {
+			w.applied[path] = true
+		}
+		if _, ok := w.remote[path]; ok {
+			w.applied[path] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Pending returns the files and URLs of the last check whose rules were never passed to onReload,
+// because they failed to load every time so far. A file that fails to load is only reported by Check
+// once until it changes, but stays pending.
+func (w *Watcher) Pending() []string {
+	var pending []string
+	for _, path := range w.order {
+		if !w.applied[path] {
+			pending = append(pending, path)
+		}
+	}
+	return pending
+}
+
+// checkFile loads a local file if it is new or changed. It reports whether its rules changed.
+func (w *Watcher) checkFile(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	prev, ok := w.files[path]
+	if ok && prev.size == info.Size() && prev.modTime.Equal(info.ModTime()) {
+		return false, nil
+	}
+
+	var rs RuleSet
+	err = rs.loadRulesFromLocalFile(path)
+	if err != nil {
+		// remember the state, so that the file is not loaded again until it changes
+		if !ok {
+			prev = &localRules{}
+			w.files[path] = prev
+		}
+		prev.size, prev.modTime = info.Size(), info.ModTime()
+		return false, err
+	}
+
+	w.files[path] = &localRules{rules: rs, loaded: true, size: info.Size(), modTime: info.ModTime()}
+	slog.Info("loaded ruleset", "path", path)
+
+	return true, nil
+}
+
+// rules returns the rules of all rulesets, in the order of their paths.
+func (w *Watcher) rules() RuleSet {
+	var rs RuleSet
+
+	for _, path := range w.order {
+		if remote, ok := w.remote[path]; ok {
+			rs = append(rs, remote.rules...)
+		}
+		if local, ok := w.files[path]; ok {
+			rs = append(rs, local.rules...)
+		}
+	}
+
+	return rs
+}
+
+// Run checks the local rulesets for changes every interval, and the remote ones every remoteInterval,
+// until ctx is done. A zero interval disables the checks. Problems are logged.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration, remoteInterval time.Duration) {
+	var local, remote <-chan time.Time
+
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		local = t.C
+	}
+
+	if remoteInterval > 0 {
+		t := time.NewTicker(remoteInterval)
+		defer t.Stop()
+		remote = t.C
+	}
+
+	if local == nil && remote == nil {
+		return
+	}
+
+	for {
+		var err error
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-local:
+			err = w.Check(false)
+		case <-remote:
+			err = w.Check(true)
+		}
+
+		if err != nil {
+			slog.Warn("failed to reload ruleset", logging.Err(err))
+		}
+		if w.OnCheck != nil {
+			w.OnCheck(err)
+		}
+	}
+}
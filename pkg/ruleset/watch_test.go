@@ -0,0 +1,198 @@
+package ruleset
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherLocal(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ruleset_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		os.WriteFile(path, []byte(content), 0o644)
+		// make every write visible, also on filesystems with a coarse modification time
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	var reloads int
+	var current RuleSet
+	w := NewWatcher(dir, func(rs RuleSet) {
+		reloads++
+		current = rs
+	})
+
+	write("- domain: example.com\n")
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, 1, reloads)
+	assert.Equal(t, "example.com", current[0].Domain)
+	assert.Empty(t, w.Pending())
+
+	// nothing changed
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, 1, reloads)
+
+	write("- domain: example.org\n")
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, "example.org", current[0].Domain)
+
+	// an invalid change keeps the last good rules
+	write("- domain: example.net\n  regexRules:\n    - match: \"(\"\n")
+	assert.Error(t, w.Check(false))
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, "example.org", current[0].Domain)
+
+	// and is not reported again until the file changes
+	assert.NoError(t, w.Check(false))
+	// it loaded before, so it is not pending
+	assert.Empty(t, w.Pending())
+
+	// a new file is picked up
+	os.WriteFile(filepath.Join(dir, "more.yaml"), []byte("- domain: example.com\n"), 0o644)
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, 3, reloads)
+	assert.Len(t, current, 2)
+}
+
+func TestWatcherPending(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.yaml")
+	broken := filepath.Join(dir, "broken.yaml")
+	missing := filepath.Join(dir, "missing")
+	os.WriteFile(good, []byte("- domain: example.com\n"), 0o644)
+	os.WriteFile(broken, []byte("- domain: example.net\n  regexRules:\n    - match: \"(\"\n"), 0o644)
+
+	var current RuleSet
+	w := NewWatcher(good+";"+broken+";"+missing, func(rs RuleSet) {
+		current = rs
+	})
+
+	assert.Error(t, w.Check(false))
+	assert.Len(t, current, 1)
+	assert.Equal(t, []string{broken, missing}, w.Pending())
+
+	// the unchanged file is not reported again, but stays pending
+	os.MkdirAll(missing, 0o755)
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, []string{broken}, w.Pending())
+
+	os.WriteFile(broken, []byte("- domain: example.net\n"), 0o644)
+	os.Chtimes(broken, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	assert.NoError(t, w.Check(false))
+	assert.Len(t, current, 2)
+	assert.Empty(t, w.Pending())
+}
+
+func TestWatcherRemote(t *testing.T) {
+	var requests, notModified atomic.Int32
+	var body atomic.Value
+	body.Store("- domain: example.com\n")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(body.Load().(string))))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	var reloads int
+	var current RuleSet
+	w := NewWatcher(server.URL+"/ruleset.yaml", func(rs RuleSet) {
+		reloads++
+		current = rs
+	})
+
+	assert.NoError(t, w.Check(true))
+	assert.Equal(t, 1, reloads)
+
+	// local checks leave remote rulesets alone
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, int32(1), requests.Load())
+
+	assert.NoError(t, w.Check(true))
+	assert.Equal(t, int32(1), notModified.Load())
+	assert.Equal(t, 1, reloads)
+
+	body.Store("- domain: example.org\n")
+	assert.NoError(t, w.Check(true))
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, "example.org", current[0].Domain)
+
+	// an invalid ruleset keeps the last good rules
+	body.Store("- domain: [example.net]\n")
+	assert.Error(t, w.Check(true))
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, "example.org", current[0].Domain)
+}
+
+func TestWatcherRemoteRetry(t *testing.T) {
+	var available atomic.Bool
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("- domain: example.com\n"))
+	}))
+	defer server.Close()
+
+	var current RuleSet
+	w := NewWatcher(server.URL+"/ruleset.yaml", func(rs RuleSet) {
+		current = rs
+	})
+
+	assert.Error(t, w.Check(true))
+	assert.Empty(t, current)
+
+	// a remote ruleset that failed to load is retried with the local checks
+	available.Store(true)
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, int32(2), requests.Load())
+	if assert.Len(t, current, 1) {
+		assert.Equal(t, "example.com", current[0].Domain)
+	}
+
+	// and left alone by them once it loaded
+	assert.NoError(t, w.Check(false))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestFetchRemoteRulesTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	defer func(timeout time.Duration) { remoteClient.Timeout = timeout }(remoteClient.Timeout)
+	remoteClient.Timeout = 50 * time.Millisecond
+
+	w := NewWatcher(server.URL+"/ruleset.yaml", func(rs RuleSet) {})
+	assert.Error(t, w.Check(true))
+}